@@ -0,0 +1,248 @@
+package holler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON = "json"
+	// AccessLogCommon writes NCSA Common Log Format.
+	AccessLogCommon = "common"
+	// AccessLogCombined writes NCSA Combined Log Format.
+	AccessLogCombined = "combined"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLogConfig configures logging of proxied requests. An empty Path or
+// "-" writes to stdout. When MaxSizeMB is set the file is rotated once it
+// would grow past it, keeping MaxBackups old files as path.1, path.2, ...
+// SampleRate (default 1) is the fraction of requests logged.
+type AccessLogConfig struct {
+	Format     string   `json:"format,omitempty"`
+	Path       string   `json:"path,omitempty"`
+	MaxSizeMB  int      `json:"max_size_mb,omitempty"`
+	MaxBackups int      `json:"max_backups,omitempty"`
+	SampleRate *float64 `json:"sample_rate,omitempty"`
+}
+
+type accessLogger struct {
+	format     string
+	sampleRate float64
+	out        io.Writer
+	sync.Mutex
+}
+
+type accessLogEntry struct {
+	Time            string  `json:"time"`
+	ClientIP        string  `json:"client_ip"`
+	Method          string  `json:"method"`
+	URI             string  `json:"uri"`
+	Proto           string  `json:"proto"`
+	Host            string  `json:"host"`
+	Backend         string  `json:"backend"`
+	Target          string  `json:"target,omitempty"`
+	Status          int     `json:"status"`
+	BytesIn         int64   `json:"bytes_in"`
+	BytesOut        int64   `json:"bytes_out"`
+	Duration        float64 `json:"duration_seconds"`
+	UpstreamLatency float64 `json:"upstream_latency_seconds"`
+	RequestID       string  `json:"request_id,omitempty"`
+	Referer         string  `json:"referer,omitempty"`
+	UserAgent       string  `json:"user_agent,omitempty"`
+}
+
+func newAccessLogger(config AccessLogConfig) (*accessLogger, error) {
+	switch config.Format {
+	case "":
+		config.Format = AccessLogJSON
+	case AccessLogJSON, AccessLogCommon, AccessLogCombined:
+	default:
+		return nil, errors.New("unknown access log format " + config.Format)
+	}
+
+	sampleRate := 1.0
+	if config.SampleRate != nil {
+		sampleRate = *config.SampleRate
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, errors.New("access log sample rate must be between 0 and 1")
+	}
+
+	var out io.Writer = os.Stdout
+	if len(config.Path) != 0 && config.Path != "-" {
+		f, err := openRotatingFile(config.Path, int64(config.MaxSizeMB)<<20, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	return &accessLogger{
+		format:     config.Format,
+		sampleRate: sampleRate,
+		out:        out,
+	}, nil
+}
+
+// log writes the access log line for a finished request, if access logging
+// is configured, enabled for the backend and the request is sampled.
+func (a *accessLogger) log(r *http.Request, state *proxyState) {
+	if a == nil || !state.backend.accessLogEnabled() {
+		return
+	}
+	if a.sampleRate < 1 && rand.Float64() >= a.sampleRate {
+		return
+	}
+
+	entry := accessLogEntry{
+		Time:            state.start.Format(time.RFC3339Nano),
+		ClientIP:        state.backend.clientAddr(r),
+		Method:          r.Method,
+		URI:             r.RequestURI,
+		Proto:           r.Proto,
+		Host:            r.Host,
+		Backend:         state.backend.NamedRoute,
+		Target:          state.targetURL(),
+		Status:          state.status,
+		BytesIn:         state.bytesIn,
+		BytesOut:        state.bytesOut,
+		Duration:        state.duration.Seconds(),
+		UpstreamLatency: state.upstream.Seconds(),
+		RequestID:       state.id,
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+	}
+
+	var line []byte
+	switch a.format {
+	case AccessLogJSON:
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	case AccessLogCommon:
+		line = []byte(commonLogLine(entry, state.start) + "\n")
+	case AccessLogCombined:
+		line = []byte(fmt.Sprintf("%s %q %q\n", commonLogLine(entry, state.start), dash(entry.Referer), dash(entry.UserAgent)))
+	}
+
+	a.Lock()
+	a.out.Write(line)
+	a.Unlock()
+}
+
+func commonLogLine(e accessLogEntry, start time.Time) string {
+	size := "-"
+	if e.BytesOut != 0 {
+		size = strconv.FormatInt(e.BytesOut, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+		e.ClientIP, start.Format(clfTimeFormat), e.Method, e.URI, e.Proto, e.Status, size)
+}
+
+func dash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// clientIP returns the address of the peer that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accessLogEnabled reports whether requests to the backend are access
+// logged. Backends log by default when an access log is configured.
+func (b *Backend) accessLogEnabled() bool {
+	return b.AccessLog == nil || *b.AccessLog
+}
+
+// rotatingFile is an append-only file that is rotated by size.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	f          *os.File
+	sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f, size, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, size: size, f: f}, nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// a failed rotation keeps writing to the current file and is retried on
+	// the next write
+	if r.maxSize != 0 && r.size != 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			logrus.WithFields(logrus.Fields{"holler": "access_log"}).Warnf("rotating %s failed: %s", r.path, err)
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N to path.N+1, dropping anything past maxBackups, and
+// starts a new file at path. The current file is only closed once the new one
+// is open.
+func (r *rotatingFile) rotate() error {
+	for i := r.maxBackups - 1; i > 0; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if r.maxBackups > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+
+	f, size, err := openAppend(r.path)
+	if err != nil {
+		return err
+	}
+	r.f.Close()
+	r.f, r.size = f, size
+	return nil
+}
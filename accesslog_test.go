@@ -0,0 +1,169 @@
+package holler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// loggedProxy registers a backend at /logged, access logged with config,
+// returning the buffer the log is written to.
+func loggedProxy(t *testing.T, config AccessLogConfig, enabled *bool) (*HollerProxy, *Target, *bytes.Buffer) {
+	h := newTestProxy(t, HollerAccessLog(config))
+	out := &bytes.Buffer{}
+	h.accessLog.out = out
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/logged", AccessLog: enabled, Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h, target, out
+}
+
+func loggedRequest() *http.Request {
+	r := httptest.NewRequest("GET", "/logged?x=1", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	r.Header.Set("User-Agent", "tester")
+	return r
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	h, target, out := loggedProxy(t, AccessLogConfig{}, nil)
+	serve(h, loggedRequest())
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("%q: %s", out.String(), err)
+	}
+	want := accessLogEntry{
+		ClientIP:  "192.0.2.1",
+		Method:    "GET",
+		URI:       "/logged?x=1",
+		Proto:     "HTTP/1.1",
+		Host:      "example.com",
+		Backend:   "/logged",
+		Target:    target.URL,
+		Status:    http.StatusCreated,
+		BytesOut:  5,
+		RequestID: "abc",
+		UserAgent: "tester",
+	}
+	if entry.Time == "" || entry.Duration <= 0 || entry.UpstreamLatency <= 0 {
+		t.Errorf("entry %+v is missing its time or latencies", entry)
+	}
+	entry.Time, entry.Duration, entry.UpstreamLatency = "", 0, 0
+	if entry != want {
+		t.Errorf("got %+v, want %+v", entry, want)
+	}
+}
+
+func TestAccessLogCommonFormats(t *testing.T) {
+	common := `192\.0\.2\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET /logged\?x=1 HTTP/1\.1" 201 5`
+	for format, pattern := range map[string]string{
+		AccessLogCommon:   "^" + common + "\n$",
+		AccessLogCombined: "^" + common + ` "-" "tester"` + "\n$",
+	} {
+		h, _, out := loggedProxy(t, AccessLogConfig{Format: format}, nil)
+		serve(h, loggedRequest())
+		if !regexp.MustCompile(pattern).MatchString(out.String()) {
+			t.Errorf("%s: got %q", format, out.String())
+		}
+	}
+
+	if _, err := newAccessLogger(AccessLogConfig{Format: "apache"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	disabled := false
+	for _, c := range []struct {
+		name     string
+		rate     *float64
+		enabled  *bool
+		min, max int
+	}{
+		{"default", nil, nil, 200, 200},
+		{"none", floatPtr(0), nil, 0, 0},
+		{"half", floatPtr(0.5), nil, 60, 140},
+		{"all", floatPtr(1), nil, 200, 200},
+		{"disabled backend", nil, &disabled, 0, 0},
+	} {
+		h, _, out := loggedProxy(t, AccessLogConfig{SampleRate: c.rate}, c.enabled)
+		for i := 0; i < 200; i++ {
+			serve(h, loggedRequest())
+		}
+		if n := strings.Count(out.String(), "\n"); n < c.min || n > c.max {
+			t.Errorf("%s: logged %d of 200 requests, want %d to %d", c.name, n, c.min, c.max)
+		}
+	}
+
+	for _, rate := range []float64{-0.1, 1.1} {
+		if _, err := newAccessLogger(AccessLogConfig{SampleRate: floatPtr(rate)}); err == nil {
+			t.Errorf("sample rate %v accepted", rate)
+		}
+	}
+}
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		if got, err := ioutil.ReadFile(path + name); err != nil || string(got) != want {
+			t.Errorf("%s holds %q (%v), want %q", filepath.Base(path+name), got, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("kept more than two backups")
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRotationFails(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("first\n"))
+
+	// without its directory the new file can't be opened, so writes go on to
+	// the current one
+	os.RemoveAll(dir)
+	if n, err := f.Write([]byte("second\n")); err != nil || n != 7 {
+		t.Fatalf("write during a failed rotation: %d, %v", n, err)
+	}
+
+	// once it can be opened the next write rotates
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("third\n"))
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != "third\n" {
+		t.Errorf("after rotating the log holds %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,183 @@
+package holler
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AffinityCookie pins clients with a cookie naming their target.
+	AffinityCookie = "cookie"
+	// AffinityClientIP pins clients by a hash of their IP.
+	AffinityClientIP = "client_ip"
+	// AffinityKey pins clients by a hash of the value of Affinity.Key.
+	AffinityKey = "key"
+
+	defaultAffinityCookie = "holler_affinity"
+)
+
+// Affinity keeps a client on the same target. The cookie mode issues a cookie,
+// named Cookie (default holler_affinity) and kept for CookieTTL seconds or
+// the browser session, naming the target that served the client. The
+// client_ip and key modes hash the client IP, or the value of Key (one of
+// header:<name>, query:<name>, cookie:<name> or jwt:<claim>), onto the healthy
+// targets. Only client_ip is available to tcp, tls and udp backends.
+// Requests whose target is unhealthy go to another one: cookie clients are
+// pinned to it from then on, hashed clients move back once their target
+// recovers. Requests without a cookie or key use the target selector.
+type Affinity struct {
+	Mode      string `json:"mode"`
+	Key       string `json:"key,omitempty"`
+	Cookie    string `json:"cookie,omitempty"`
+	CookieTTL int    `json:"cookie_ttl,omitempty"`
+}
+
+func (a *Affinity) validate(isHTTP bool) error {
+	switch a.Mode {
+	case AffinityClientIP:
+		return nil
+	case AffinityCookie:
+		if len(a.Cookie) == 0 {
+			a.Cookie = defaultAffinityCookie
+		}
+		if a.CookieTTL < 0 {
+			return errors.New("affinity cookie_ttl can not be negative")
+		}
+	case AffinityKey:
+		kind, name := splitKey(a.Key)
+		switch kind {
+		case "header", "query", "cookie", "jwt":
+		default:
+			return errors.New("affinity key must be header:, query:, cookie: or jwt:, got " + a.Key)
+		}
+		if len(name) == 0 {
+			return errors.New("affinity key " + a.Key + " has no name")
+		}
+	default:
+		return errors.New("unknown affinity mode " + a.Mode)
+	}
+	if !isHTTP {
+		return errors.New("affinity mode " + a.Mode + " requires an http backend")
+	}
+	return nil
+}
+
+// affinityTarget returns the candidate the request is pinned to, if any.
+func (b *Backend) affinityTarget(r *http.Request, client string, candidates []*Target) *Target {
+	if key := b.affinityHashKey(r, client); len(key) != 0 {
+		return rendezvous(candidates, key)
+	}
+	return b.affinityCookieTarget(r, candidates)
+}
+
+// affinityHashKey returns the value the client_ip and key modes hash, or ""
+// when the request has none.
+func (b *Backend) affinityHashKey(r *http.Request, client string) string {
+	if b.Affinity == nil {
+		return ""
+	}
+	switch b.Affinity.Mode {
+	case AffinityClientIP:
+		return client
+	case AffinityKey:
+		if r != nil {
+			return requestKey(r, b.Affinity.Key)
+		}
+	}
+	return ""
+}
+
+// affinityCookieTarget returns the candidate named by the affinity cookie.
+func (b *Backend) affinityCookieTarget(r *http.Request, candidates []*Target) *Target {
+	if b.Affinity == nil || b.Affinity.Mode != AffinityCookie || r == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(b.Affinity.Cookie)
+	if err != nil {
+		return nil
+	}
+	for _, t := range candidates {
+		if targetID(t) == cookie.Value {
+			return t
+		}
+	}
+	return nil
+}
+
+// addrIP returns the IP of a tcp or udp client address.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// rendezvous picks the candidate scoring highest for key. A key only moves
+// when its target is no longer a candidate.
+func rendezvous(candidates []*Target, key string) *Target {
+	var (
+		best      *Target
+		bestScore uint64
+	)
+	for _, t := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(t.URL))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	return best
+}
+
+// targetID names a target in affinity cookies without exposing its URL.
+func targetID(t *Target) string {
+	h := fnv.New64a()
+	h.Write([]byte(t.URL))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// cookiePath returns the static part of a route, up to the last slash before
+// its first {variable}, so the cookie is sent on every path the route matches.
+func cookiePath(route string) string {
+	i := strings.Index(route, "{")
+	if i < 0 {
+		return route
+	}
+	if slash := strings.LastIndex(route[:i], "/"); slash >= 0 {
+		return route[:slash+1]
+	}
+	return "/"
+}
+
+// setAffinityCookie pins the client to the target that served resp, unless
+// it already is.
+func (b *Backend) setAffinityCookie(resp *http.Response) {
+	a := b.Affinity
+	if a == nil || a.Mode != AffinityCookie {
+		return
+	}
+	target := proxyStateFrom(resp.Request).target
+	if target == nil {
+		return
+	}
+
+	id := targetID(target)
+	if cookie, err := resp.Request.Cookie(a.Cookie); err == nil && cookie.Value == id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     a.Cookie,
+		Value:    id,
+		Path:     cookiePath(b.NamedRoute),
+		MaxAge:   a.CookieTTL,
+		HttpOnly: true,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,50 @@
+package holler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookiePath(t *testing.T) {
+	for route, want := range map[string]string{
+		"/foo":               "/foo",
+		"/users/{id}":        "/users/",
+		"/users/{id}/orders": "/users/",
+		"/v{version}/items":  "/",
+		"/{any}":             "/",
+	} {
+		if got := cookiePath(route); got != want {
+			t.Errorf("%s: got %q, want %q", route, got, want)
+		}
+	}
+}
+
+func TestAffinityCookieOnTemplateRoute(t *testing.T) {
+	h := newTestProxy(t)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	b := &Backend{
+		NamedRoute: "/users/{id}",
+		Affinity:   &Affinity{Mode: AffinityCookie, Cookie: "srv"},
+		Targets:    []*Target{upstream(t, ok), upstream(t, ok)},
+	}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(h, httptest.NewRequest("GET", "/users/42", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	if cookies[0].Path != "/users/" {
+		t.Errorf("got cookie path %q, want /users/", cookies[0].Path)
+	}
+
+	// a client presenting the cookie on another user's path is not re-pinned
+	r := httptest.NewRequest("GET", "/users/7", nil)
+	r.AddCookie(&http.Cookie{Name: "srv", Value: cookies[0].Value})
+	if got := serve(h, r).Result().Cookies(); len(got) != 0 {
+		t.Errorf("pinned client got a new cookie %v", got)
+	}
+}
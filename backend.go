@@ -1,86 +1,290 @@
 package holler
 
 import (
+	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/oxtoacart/bpool"
 )
 
+const (
+	// KindHTTP backends are mounted on the holler router and reverse proxied.
+	KindHTTP = "http"
+	// KindTCP backends listen on their own address and proxy raw TCP.
+	KindTCP = "tcp"
+	// KindTLS backends listen on their own address and route TLS connections
+	// by ClientHello server name without terminating them.
+	KindTLS = "tls"
+	// KindUDP backends listen on their own address and relay datagrams,
+	// keeping each client address pinned to one target.
+	KindUDP = "udp"
+)
+
 // Backend abstracts the configuration and targets for a backend
 // request. Targets are assumed to be fully qualified url.URL which
 // can pass url.Parse(target).
-// TargetSelector can by one of: random, roundrobin.
+// TargetSelector can by one of: first (default), random, roundrobin,
+// leastconn, peak_ewma, ring_hash, maglev.
 // If ProxyBuffer settings are nil, no buffering occurs.
 type Backend struct {
-	NamedRoute          string    `json:"route"`
-	ProxyBufferSize     int       `json:"proxy_buffer_size,omitempty"`
-	TargetSelector      string    `json:"target_selector,omitempty"`
-	Targets             []*Target `json:"targets,omitempty"`
-	HealthCheckInterval int       `json:"health_check_interval,omitempty"`
-	proxy               *httputil.ReverseProxy
+	NamedRoute string `json:"route"`
+	// Kind defaults to http. The tcp, tls and udp kinds require Listen
+	Kind   string `json:"kind,omitempty"`
+	Listen string `json:"listen,omitempty"`
+	// ServerNames picks the tls backend of a shared Listen address by SNI,
+	// a tls backend without any gets the connections no other one matches
+	ServerNames     []string         `json:"server_names,omitempty"`
+	ProxyBufferSize int              `json:"proxy_buffer_size,omitempty"`
+	TargetSelector  string           `json:"target_selector,omitempty"`
+	Affinity        *Affinity        `json:"affinity,omitempty"`
+	Hashing         *HashConfig      `json:"hashing,omitempty"`
+	EWMA            *EWMAConfig      `json:"ewma,omitempty"`
+	Failover        *FailoverConfig  `json:"failover,omitempty"`
+	SlowStart       *SlowStartConfig `json:"slow_start,omitempty"`
+	// Groups replace Targets with target groups splitting traffic by weight
+	Groups              []*TargetGroup   `json:"groups,omitempty"`
+	GroupOverride       *GroupOverride   `json:"group_override,omitempty"`
+	Mirror              *MirrorConfig    `json:"mirror,omitempty"`
+	Canary              *CanaryConfig    `json:"canary,omitempty"`
+	Faults              []*FaultRule     `json:"faults,omitempty"`
+	Targets             []*Target        `json:"targets,omitempty"`
+	Discovery           *DiscoveryConfig `json:"discovery,omitempty"`
+	HealthCheckInterval int              `json:"health_check_interval,omitempty"`
+	// UDPSessionTimeout closes udp client sessions idle for that many
+	// seconds (default 30)
+	UDPSessionTimeout int `json:"udp_session_timeout,omitempty"`
+	// AccessLog turns access logging of an http backend off, or back on
+	AccessLog *bool `json:"access_log,omitempty"`
+	// TraceSampleRatio overrides the sample ratio of new traces
+	TraceSampleRatio *float64 `json:"trace_sample_ratio,omitempty"`
+	// TrustedProxies are the peers whose forwarding headers are passed on
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// RewriteHost sends the target's host upstream instead of the client's
+	RewriteHost bool `json:"rewrite_host,omitempty"`
+	// XForwarded adds X-Forwarded-Proto/Host/Port, Forwarded an RFC 7239
+	// element and Via a Via entry under its name
+	XForwarded      bool           `json:"x_forwarded,omitempty"`
+	Forwarded       bool           `json:"forwarded,omitempty"`
+	Via             string         `json:"via,omitempty"`
+	RequestHeaders  *HeaderRules   `json:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules   `json:"response_headers,omitempty"`
+	Rewrites        []*RewriteRule `json:"rewrites,omitempty"`
+	Query           *QueryRules    `json:"query,omitempty"`
+	Redirect        *Redirect      `json:"redirect,omitempty"`
+	// RateLimits, like Faults, can be replaced at runtime
+	RateLimits  []*RateLimit       `json:"rate_limits,omitempty"`
+	Concurrency *ConcurrencyLimit  `json:"concurrency,omitempty"`
+	Cache       *CacheConfig       `json:"cache,omitempty"`
+	Coalesce    *CoalesceConfig    `json:"coalesce,omitempty"`
+	Compression *CompressionConfig `json:"compression,omitempty"`
+	proxy       *httputil.ReverseProxy
+	handler     http.Handler
+	trustedNets []*net.IPNet
+	selector    targetSelector
+	concurrency *concurrencyLimiter
+	cache       *backendCache
+	coalescer   *coalescer
+	compressor  *compressor
+	mirror      *mirror
+	canary      *canary
+	discovery   *discovery
+	// mu guards configuration that can change after registration
+	mu sync.RWMutex
 }
 
-// SelectHealthy chooses a healthy target via RRD selection.
-func (b *Backend) SelectHealthy() (*Target, error) {
-	for _, t := range b.Targets {
-		if t.Healthy {
-			return t, nil
-		}
-	}
-	return nil, errors.New("no healthy targets")
+// isHTTP reports whether the backend is served through the holler router.
+func (b *Backend) isHTTP() bool {
+	return b.Kind == KindHTTP
 }
 
 /* HollerProxy methods specific to Backend{} manipulation */
 
 // RegisterBackend adds a new backend to Holler
 func (h *HollerProxy) RegisterBackend(b *Backend) error {
-	if _, ok := h.Backends[b.NamedRoute]; ok {
+	if b.HealthCheckInterval == 0 {
+		b.HealthCheckInterval = 5
+	}
+
+	if len(b.Kind) == 0 {
+		b.Kind = KindHTTP
+	}
+
+	// fail a duplicate before resolving discovered targets, which can be
+	// slow, outside the lock; it is checked again under the lock below
+	if _, err := h.registeredBackend(b.NamedRoute); err == nil {
 		return errors.New("backend " + b.NamedRoute + " already registered, ignoring")
 	}
 
-	if b.HealthCheckInterval == 0 {
-		b.HealthCheckInterval = 5
+	// resolve discovered targets before taking the lock, lookups can be slow
+	var next time.Duration
+	if b.Discovery != nil {
+		discovery, err := newDiscovery(b)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		b.discovery = discovery
+		if next, err = discovery.refresh(); err != nil {
+			h.Log.Warnf("discovery of %s for backend %s failed: %s", b.Discovery.Name, b.NamedRoute, err)
+		}
 	}
 
 	h.Lock()
 	defer h.Unlock()
 
+	if _, ok := h.Backends[b.NamedRoute]; ok {
+		return errors.New("backend " + b.NamedRoute + " already registered, ignoring")
+	}
+
+	if err := b.configureSelection(); err != nil {
+		return err
+	}
+
+	switch b.Kind {
+	case KindHTTP:
+	case KindTCP, KindTLS:
+		if err := h.startL4(b); err != nil {
+			return err
+		}
+		h.startDiscovery(b, next)
+		h.Backends[b.NamedRoute] = b
+		h.metrics.registrations.add(1, "register")
+		h.Log.Debugf("establishing %s backend %s on %s\n    Targets: %+v", b.Kind, b.NamedRoute, b.Listen, b.Targets)
+		return nil
+	case KindUDP:
+		if err := h.startUDP(b); err != nil {
+			return err
+		}
+		h.startDiscovery(b, next)
+		h.Backends[b.NamedRoute] = b
+		h.metrics.registrations.add(1, "register")
+		h.Log.Debugf("establishing %s backend %s on %s\n    Targets: %+v", b.Kind, b.NamedRoute, b.Listen, b.Targets)
+		return nil
+	default:
+		return errors.New("backend " + b.NamedRoute + " has unknown kind " + b.Kind)
+	}
+
+	if err := b.parseTrustedProxies(); err != nil {
+		return err
+	}
+
+	if err := b.compileRewrites(); err != nil {
+		return err
+	}
+
+	if err := b.SetRateLimits(b.RateLimits); err != nil {
+		return err
+	}
+
+	if err := b.SetFaults(b.Faults); err != nil {
+		return err
+	}
+
+	if b.Concurrency != nil {
+		limiter, err := newConcurrencyLimiter(b.Concurrency)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		b.concurrency = limiter
+	}
+
+	if b.Cache != nil {
+		cache, err := newBackendCache(b.Cache)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		if b.Affinity != nil && b.Affinity.Mode == AffinityCookie {
+			cache.affinityCookie = b.Affinity.Cookie
+		}
+		b.cache = cache
+	}
+
+	if b.Coalesce != nil {
+		b.coalescer = newCoalescer(b.Coalesce)
+	}
+
+	if b.Compression != nil {
+		compressor, err := newCompressor(b.Compression)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		b.compressor = compressor
+	}
+
+	if b.Mirror != nil {
+		mirror, err := newMirror(b.Mirror)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		b.mirror = mirror
+	}
+
+	if b.Canary != nil {
+		canary, err := newCanary(b)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		b.canary = canary
+	}
+
 	director := func(req *http.Request) {
-		h.Log.Debugf("calling backend director for %s", b.NamedRoute)
-		if len(b.Targets) == 0 {
-			h.Log.Errorf("targets for backend %s are empty, bailing out", b.NamedRoute)
+		log := h.logFor(req)
+		log.Debugf("calling backend director for %s", b.NamedRoute)
+		if len(b.allTargets()) == 0 {
+			log.Errorf("targets for backend %s are empty, bailing out", b.NamedRoute)
 			return
 		}
 
+		state := proxyStateFrom(req)
+		var selectSpan *Span
+		if state.span != nil {
+			selectSpan = h.tracer.child(state.span, "select target", SpanInternal)
+			defer h.tracer.end(selectSpan)
+		}
+
 		// Need leastConn, roundRobin, etc
-		target, err := b.SelectHealthy()
-		if err != nil {
-			h.Log.Error(err)
-			return
+		target := state.target
+		if target == nil {
+			var err error
+			target, err = b.selectTarget(req, b.clientAddr(req), nil)
+			if err != nil {
+				selectSpan.setError(err)
+				log.Error(err)
+				return
+			}
+			state.target = target
+		}
+		if selectSpan != nil {
+			selectSpan.Attributes["holler.target"] = target.URL
 		}
+
 		targetURL, err := url.Parse(target.URL)
 		if err != nil {
-			h.Log.Error(err)
+			log.Error(err)
 			return
 		}
 
-		h.Log.Debugf("making backend request for %s:\n    Scheme %s\n    Host %s\n    Path %s", b.NamedRoute, targetURL.Scheme, targetURL.Host, targetURL.Path)
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-		req.URL.Path = targetURL.Path
+		log.Debugf("making backend request for %s:\n    Scheme %s\n    Host %s\n    Path %s", b.NamedRoute, targetURL.Scheme, targetURL.Host, targetURL.Path)
+		b.prepareUpstream(req, targetURL)
 	}
 
 	b.proxy = &httputil.ReverseProxy{
 		Director: director,
-		Transport: &http.Transport{
-			Proxy: func(req *http.Request) (*url.URL, error) {
-				h.Log.Debugf("making backend request to %s", req.URL.Host)
-				return http.ProxyFromEnvironment(req)
+		Transport: &upstreamTransport{
+			RoundTripper: &http.Transport{
+				Proxy: func(req *http.Request) (*url.URL, error) {
+					h.logFor(req).Debugf("making backend request to %s", req.URL.Host)
+					return http.ProxyFromEnvironment(req)
+				},
 			},
+			h:       h,
+			backend: b,
 		},
 	}
 
@@ -90,37 +294,154 @@ func (h *HollerProxy) RegisterBackend(b *Backend) error {
 		b.proxy.BufferPool = bpool.NewBytePool(b.ProxyBufferSize, b.ProxyBufferSize)
 	}
 
+	b.proxy.ModifyResponse = h.modifyResponse(b)
+
+	var inner http.Handler = b.proxy
+	if b.Redirect != nil {
+		inner = b.Redirect
+	}
+	inner = h.limitConcurrency(inner, b)
+	inner = h.coalesce(inner, b)
+	inner = h.cache(inner, b)
+	inner = h.compress(inner, b)
+	inner = h.mirror(inner, b)
+	inner = h.injectFaults(inner, b)
+	inner = h.rateLimit(inner, b)
+	b.handler = h.withRequestID(h.track(inner, b))
+
 	h.Backends[b.NamedRoute] = b
+	h.metrics.registrations.add(1, "register")
 	h.Log.Debugf("establishing backend %s\n    Targets: %+v", b.NamedRoute, b.Targets)
-	h.Server.Handler.(*mux.Router).NewRoute().
-		Name(b.NamedRoute).
-		Path(b.NamedRoute).
-		Handler(b.proxy)
+	h.mountBackend(h.Server.Handler.(*mux.Router), b)
+	if b.canary != nil {
+		go b.canary.run(h.Log)
+	}
+	h.startDiscovery(b, next)
 
 	return nil
 }
 
+// prepareUpstream points req at targetURL, rewriting its path and query and
+// setting its forwarding and configured request headers.
+func (b *Backend) prepareUpstream(req *http.Request, targetURL *url.URL) {
+	req.URL.Scheme = targetURL.Scheme
+	req.URL.Host = targetURL.Host
+	if path, ok := b.rewritePath(req.URL.Path); ok {
+		req.URL.Path = singleJoiningSlash(targetURL.Path, path)
+		req.URL.RawPath = ""
+	} else {
+		req.URL.Path = targetURL.Path
+	}
+	b.Query.apply(req)
+	b.forwardHeaders(req, targetURL)
+	b.RequestHeaders.apply(req.Header, req)
+}
+
+// modifyResponse returns the ReverseProxy.ModifyResponse hook for b.
+func (h *HollerProxy) modifyResponse(b *Backend) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		// the request ID was already set on the client response, an upstream
+		// echoing it back would otherwise duplicate it
+		resp.Header.Del(h.RequestIDHeader)
+		b.ResponseHeaders.apply(resp.Header, resp.Request)
+		b.setAffinityCookie(resp)
+		return nil
+	}
+}
+
+// mountBackend adds the route for an http backend to router.
+func (h *HollerProxy) mountBackend(router *mux.Router, b *Backend) {
+	router.NewRoute().
+		Name(b.NamedRoute).
+		Path(b.NamedRoute).
+		Handler(b.handler)
+}
+
 // DeleteBackend removes a backend from holler.
 // Note:
 //   Gorilla mux doesn't have a way to delete a route in memory. At the risk of
 //   re-writting that library, here we're building a new http.Handlerfrom our
 //   default API routes plus the updated backends with the desired backend deleted.
 func (h *HollerProxy) DeleteBackend(b *Backend) error {
-	if _, ok := h.Backends[b.NamedRoute]; !ok {
+	h.Lock()
+	defer h.Unlock()
+
+	registered, ok := h.Backends[b.NamedRoute]
+	if !ok {
 		return errors.New("unable to delete backend " + b.NamedRoute + " does not exist")
 	}
 
 	delete(h.Backends, b.NamedRoute)
+	h.metrics.registrations.add(1, "delete")
+	h.metrics.forgetBackend(b.NamedRoute)
 
-	h.Server.Handler = newRouter(h)
+	if registered.canary != nil {
+		registered.canary.close()
+	}
+	if registered.discovery != nil {
+		registered.discovery.close()
+	}
 
+	switch registered.Kind {
+	case KindTCP, KindTLS:
+		return h.stopL4(registered)
+	case KindUDP:
+		return h.stopUDP(registered)
+	}
+
+	router := newRouter(h)
 	for n, b := range h.Backends {
+		if !b.isHTTP() {
+			continue
+		}
 		h.Log.Debugf("re-registering backend %s", n)
-		h.Server.Handler.(*mux.Router).NewRoute().
-			Name(b.NamedRoute).
-			Path(b.NamedRoute).
-			Handler(b.proxy)
+		h.mountBackend(router, b)
 	}
+	h.Server.Handler = router
 
 	return nil
 }
+
+// backendList returns a snapshot of the registered backends which is safe to
+// range over while backends are being registered or deleted.
+func (h *HollerProxy) backendList() []*Backend {
+	h.Lock()
+	defer h.Unlock()
+
+	backends := make([]*Backend, 0, len(h.Backends))
+	for _, b := range h.Backends {
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// registeredBackend looks up a registered backend by route.
+func (h *HollerProxy) registeredBackend(route string) (*Backend, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	b, ok := h.Backends[route]
+	if !ok {
+		return nil, errors.New("backend " + route + " does not exist")
+	}
+	return b, nil
+}
+
+// backendsJSON marshals the registered backends, each under its lock as
+// their limits, faults, targets and group weights change at runtime.
+func (h *HollerProxy) backendsJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	backends := make(map[string]json.RawMessage, len(h.Backends))
+	for route, b := range h.Backends {
+		b.mu.RLock()
+		data, err := json.Marshal(b)
+		b.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		backends[route] = data
+	}
+	return json.Marshal(backends)
+}
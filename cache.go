@@ -0,0 +1,551 @@
+package holler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMaxBytes = 64 << 20
+	cacheStatusHeader    = "X-Cache"
+)
+
+// CacheConfig enables an HTTP cache in front of a backend's targets. Responses
+// are kept in memory up to MaxBytes (default 64MB) and, when Dir is set, on
+// disk up to MaxDiskBytes (default 1GB). Responses larger than MaxEntryBytes
+// (default MaxBytes/16) are not cached. DefaultTTL is the freshness, in
+// seconds, given to cacheable responses that carry no Cache-Control or
+// Expires lifetime; left at 0 such responses are only stored when they carry
+// a validator and are always revalidated.
+type CacheConfig struct {
+	MaxBytes      int64  `json:"max_bytes,omitempty"`
+	MaxEntryBytes int64  `json:"max_entry_bytes,omitempty"`
+	Dir           string `json:"dir,omitempty"`
+	MaxDiskBytes  int64  `json:"max_disk_bytes,omitempty"`
+	DefaultTTL    int    `json:"default_ttl,omitempty"`
+}
+
+// backendCache is the cache of a single backend.
+type backendCache struct {
+	config       *CacheConfig
+	store        *responseCache
+	revalidating map[string]bool
+	// affinityCookie is left out of stored responses, as holler sets it per
+	// client on the way out of the proxy
+	affinityCookie string
+	sync.Mutex
+}
+
+func newBackendCache(config *CacheConfig) (*backendCache, error) {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultCacheMaxBytes
+	}
+	if config.MaxEntryBytes <= 0 {
+		config.MaxEntryBytes = config.MaxBytes / 16
+	}
+	if config.MaxDiskBytes <= 0 {
+		config.MaxDiskBytes = 1 << 30
+	}
+	if config.DefaultTTL < 0 {
+		return nil, errors.New("cache default_ttl can not be negative")
+	}
+
+	store, err := newResponseCache(config)
+	if err != nil {
+		return nil, err
+	}
+	return &backendCache{
+		config:       config,
+		store:        store,
+		revalidating: make(map[string]bool),
+	}, nil
+}
+
+// cacheKey is the request URI, which is also what purges match against.
+func cacheKey(r *http.Request) string {
+	return r.URL.RequestURI()
+}
+
+// variantKey is the key of the variant of a response varying by the request
+// headers names, which follows the request URI after a newline.
+func variantKey(r *http.Request, names []string) string {
+	key := cacheKey(r)
+	for _, name := range names {
+		key += "\n" + name + ":" + strings.Join(r.Header[name], ",")
+	}
+	return key
+}
+
+// lookup returns the stored response for r. Responses with a Vary header are
+// stored under their variant key, and under the request URI an entry naming
+// the headers they vary by.
+func (c *backendCache) lookup(r *http.Request) (*cacheEntry, bool) {
+	e, ok := c.store.get(cacheKey(r))
+	if ok && e.VaryBy != nil {
+		e, ok = c.store.get(variantKey(r, e.VaryBy))
+	}
+	if !ok || !e.matches(r) {
+		return nil, false
+	}
+	return e, true
+}
+
+// put stores e, along with the entry pointing at its variants if it has
+// any.
+func (c *backendCache) put(r *http.Request, e *cacheEntry) {
+	if len(e.Vary) != 0 {
+		names := make([]string, 0, len(e.Vary))
+		for name := range e.Vary {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.store.set(&cacheEntry{Key: cacheKey(r), VaryBy: names, Stored: e.Stored})
+	}
+	c.store.set(e)
+}
+
+// withoutCookie returns header without the Set-Cookie lines setting name.
+func withoutCookie(header http.Header, name string) http.Header {
+	if len(name) == 0 || len(header["Set-Cookie"]) == 0 {
+		return header
+	}
+	header = cloneHeader(header)
+	var kept []string
+	for _, line := range header["Set-Cookie"] {
+		if i := strings.Index(line, "="); i < 0 || strings.TrimSpace(line[:i]) != name {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == 0 {
+		header.Del("Set-Cookie")
+	} else {
+		header["Set-Cookie"] = kept
+	}
+	return header
+}
+
+// cacheControl parses a Cache-Control header into directive -> value.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, line := range header["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if len(part) == 0 {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus are the status codes cacheable by default (RFC 7231 6.1).
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// newEntry builds a cache entry from an upstream response to r, or returns
+// nil if the response may not be stored by a shared cache.
+func (c *backendCache) newEntry(r *http.Request, status int, header http.Header, body []byte, now time.Time) *cacheEntry {
+	if !cacheableStatus[status] || r.Method != "GET" {
+		return nil
+	}
+	header = withoutCookie(header, c.affinityCookie)
+	if len(header["Set-Cookie"]) != 0 || header.Get("Vary") == "*" {
+		return nil
+	}
+
+	cc := cacheControl(header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	if len(r.Header.Get("Authorization")) != 0 {
+		_, public := cc["public"]
+		_, shared := cc["s-maxage"]
+		if !public && !shared {
+			return nil
+		}
+	}
+
+	e := &cacheEntry{
+		Key:    cacheKey(r),
+		Status: status,
+		Header: cloneHeader(header),
+		Body:   body,
+		Stored: now,
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		e.InitialAge = time.Duration(age) * time.Second
+	}
+
+	_, noCache := cc["no-cache"]
+	explicit := true
+	if d, ok := directiveSeconds(cc, "s-maxage"); ok {
+		e.FreshFor = d
+	} else if d, ok := directiveSeconds(cc, "max-age"); ok {
+		e.FreshFor = d
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		e.FreshFor = expires.Sub(date)
+	} else {
+		explicit = false
+		e.FreshFor = time.Duration(c.config.DefaultTTL) * time.Second
+	}
+	if noCache {
+		e.FreshFor = 0
+	}
+
+	if _, ok := cc["must-revalidate"]; !ok {
+		e.StaleWhileRevalidate, _ = directiveSeconds(cc, "stale-while-revalidate")
+		e.StaleIfError, _ = directiveSeconds(cc, "stale-if-error")
+	}
+
+	validators := len(header.Get("ETag")) != 0 || len(header.Get("Last-Modified")) != 0
+	if e.FreshFor <= 0 && !validators && !(explicit && e.StaleIfError > 0) {
+		return nil
+	}
+
+	if vary := header.Get("Vary"); len(vary) != 0 {
+		e.Vary = map[string]string{}
+		var names []string
+		for _, name := range strings.Split(vary, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if _, ok := e.Vary[name]; len(name) == 0 || ok {
+				continue
+			}
+			e.Vary[name] = strings.Join(r.Header[name], ",")
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		e.Key = variantKey(r, names)
+	}
+	return e
+}
+
+// matches reports whether the request selects the same variant as the one
+// stored.
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(r.Header[name], ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// serve writes a cached entry to the client, answering conditional requests
+// with 304 where the entry's validators allow.
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request, status string, now time.Time) {
+	header := w.Header()
+	for k, v := range e.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	header.Set(cacheStatusHeader, status)
+
+	if notModified(r, e.Header) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		w.Write(e.Body)
+	}
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since.
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); len(inm) != 0 {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if len(etag) == 0 {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
+
+// cacheWriter sits between the proxy and the client. It collects the
+// upstream response headers in its own map, so they can be stored without the
+// headers holler adds itself, and asks decide whether the response goes on to
+// the client. Bodies are buffered for storing up to limit bytes.
+type cacheWriter struct {
+	client  http.ResponseWriter
+	header  http.Header
+	decide  func(status int, header http.Header) bool
+	limit   int64
+	status  int
+	forward bool
+	body    bytes.Buffer
+	tooBig  bool
+}
+
+func newCacheWriter(client http.ResponseWriter, limit int64, decide func(int, http.Header) bool) *cacheWriter {
+	return &cacheWriter{client: client, header: http.Header{}, limit: limit, decide: decide}
+}
+
+func (c *cacheWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *cacheWriter) WriteHeader(status int) {
+	if c.status != 0 || status < 200 {
+		return
+	}
+	c.status = status
+	c.forward = c.decide == nil || c.decide(status, c.header)
+	if c.forward {
+		dst := c.client.Header()
+		for k, v := range c.header {
+			dst[k] = v
+		}
+		c.client.WriteHeader(status)
+	}
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.tooBig {
+		if int64(c.body.Len()+len(p)) > c.limit {
+			c.tooBig = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(p)
+		}
+	}
+	if c.forward {
+		return c.client.Write(p)
+	}
+	return len(p), nil
+}
+
+func (c *cacheWriter) Flush() {
+	if f, ok := c.client.(http.Flusher); ok && c.forward {
+		f.Flush()
+	}
+}
+
+// cache wraps the handler of an http backend with its response cache.
+func (h *HollerProxy) cache(inner http.Handler, b *Backend) http.Handler {
+	if b.cache == nil {
+		return inner
+	}
+	c := b.cache
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			c.store.purge(cacheKey(r), false)
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		reqCC := cacheControl(r.Header)
+		if _, ok := reqCC["no-store"]; ok {
+			h.metrics.cache.add(1, b.NamedRoute, "bypass")
+			w.Header().Set(cacheStatusHeader, "BYPASS")
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		entry, ok := c.lookup(r)
+		if !ok {
+			h.metrics.cache.add(1, b.NamedRoute, "miss")
+			c.fetch(w, r, inner, now)
+			return
+		}
+
+		_, noCache := reqCC["no-cache"]
+		switch {
+		case entry.fresh(now) && !noCache:
+			h.metrics.cache.add(1, b.NamedRoute, "hit")
+			entry.serve(w, r, "HIT", now)
+		case !noCache && entry.FreshFor > 0 && entry.staleFor(now) < entry.StaleWhileRevalidate:
+			h.metrics.cache.add(1, b.NamedRoute, "stale")
+			entry.serve(w, r, "STALE", now)
+			c.revalidateInBackground(r, inner, entry)
+		default:
+			h.metrics.cache.add(1, b.NamedRoute, "revalidate")
+			c.revalidate(w, r, inner, entry, now)
+		}
+	})
+}
+
+// fetch passes a miss upstream, streaming the response to the client and
+// storing it if it is cacheable.
+func (c *backendCache) fetch(w http.ResponseWriter, r *http.Request, inner http.Handler, now time.Time) {
+	w.Header().Set(cacheStatusHeader, "MISS")
+	cw := newCacheWriter(w, c.config.MaxEntryBytes, nil)
+	inner.ServeHTTP(cw, r)
+	c.save(r, cw, now)
+}
+
+// save stores the response collected by cw if it is cacheable.
+func (c *backendCache) save(r *http.Request, cw *cacheWriter, now time.Time) {
+	if cw.tooBig || cw.status == 0 {
+		return
+	}
+	if e := c.newEntry(r, cw.status, cw.header, cw.body.Bytes(), now); e != nil {
+		c.put(r, e)
+	}
+}
+
+// conditional returns a copy of r asking the upstream to validate entry.
+func conditional(r *http.Request, entry *cacheEntry) *http.Request {
+	rv := r.Clone(r.Context())
+	rv.Method = "GET"
+	rv.Header.Del("If-None-Match")
+	rv.Header.Del("If-Modified-Since")
+	if etag := entry.Header.Get("ETag"); len(etag) != 0 {
+		rv.Header.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); len(lm) != 0 {
+		rv.Header.Set("If-Modified-Since", lm)
+	}
+	return rv
+}
+
+// revalidate validates a stale entry with the upstream before answering. A
+// 304 refreshes and serves the entry, a 5xx within stale-if-error serves it
+// stale, and anything else goes to the client as a new response.
+func (c *backendCache) revalidate(w http.ResponseWriter, r *http.Request, inner http.Handler, entry *cacheEntry, now time.Time) {
+	rv := conditional(r, entry)
+	useStale := func(status int) bool {
+		return status >= 500 && entry.staleFor(now) < entry.StaleIfError
+	}
+
+	cw := newCacheWriter(w, c.config.MaxEntryBytes, func(status int, header http.Header) bool {
+		if status == http.StatusNotModified || useStale(status) {
+			return false
+		}
+		w.Header().Set(cacheStatusHeader, "MISS")
+		return true
+	})
+	inner.ServeHTTP(cw, rv)
+
+	switch {
+	case cw.status == http.StatusNotModified:
+		refreshed := c.refresh(rv, entry, cw.header, time.Now())
+		refreshed.serve(w, r, "REVALIDATED", time.Now())
+	case useStale(cw.status):
+		entry.serve(w, r, "STALE", time.Now())
+	default:
+		c.save(rv, cw, now)
+	}
+}
+
+// refresh stores entry again with the headers and freshness of a 304.
+func (c *backendCache) refresh(r *http.Request, entry *cacheEntry, header http.Header, now time.Time) *cacheEntry {
+	merged := cloneHeader(entry.Header)
+	for k, v := range header {
+		merged[k] = v
+	}
+	refreshed := c.newEntry(r, entry.Status, merged, entry.Body, now)
+	if refreshed == nil {
+		return entry
+	}
+	c.put(r, refreshed)
+	return refreshed
+}
+
+// revalidateInBackground refreshes an entry served under
+// stale-while-revalidate, at most once at a time per key.
+func (c *backendCache) revalidateInBackground(r *http.Request, inner http.Handler, entry *cacheEntry) {
+	c.Lock()
+	if c.revalidating[entry.Key] {
+		c.Unlock()
+		return
+	}
+	c.revalidating[entry.Key] = true
+	c.Unlock()
+
+	state := proxyStateFrom(r)
+	rv := conditional(r, entry).WithContext(context.WithoutCancel(r.Context()))
+	rv = withProxyState(rv, &proxyState{backend: state.backend, start: time.Now(), id: state.id})
+
+	go func() {
+		defer func() {
+			c.Lock()
+			delete(c.revalidating, entry.Key)
+			c.Unlock()
+		}()
+
+		cw := newCacheWriter(discardWriter{header: http.Header{}}, c.config.MaxEntryBytes, nil)
+		inner.ServeHTTP(cw, rv)
+		if cw.status == http.StatusNotModified {
+			c.refresh(rv, entry, cw.header, time.Now())
+			return
+		}
+		c.save(rv, cw, time.Now())
+	}()
+}
+
+// discardWriter is the client of background revalidations.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+// purgeCache removes cached responses of a backend by key, or by key prefix.
+func (b *Backend) purgeCache(key string, prefix bool) (int, error) {
+	if b.cache == nil {
+		return 0, errors.New("backend " + b.NamedRoute + " has no cache")
+	}
+	return b.cache.store.purge(key, prefix), nil
+}
@@ -0,0 +1,151 @@
+package holler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cachedProxy registers a backend at /cached with config, whose upstream
+// answers with the request's Accept-Language, varying by it.
+func cachedProxy(t *testing.T, config *CacheConfig) (*HollerProxy, *int64) {
+	h := newTestProxy(t)
+	var requests int64
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/cached", Cache: config, Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h, &requests
+}
+
+func getCached(h *HollerProxy, language string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/cached", nil)
+	if len(language) != 0 {
+		r.Header.Set("Accept-Language", language)
+	}
+	return serve(h, r)
+}
+
+func TestCacheKeepsVariants(t *testing.T) {
+	h, requests := cachedProxy(t, &CacheConfig{})
+
+	for _, language := range []string{"en", "de", ""} {
+		if rec := getCached(h, language); rec.Header().Get(cacheStatusHeader) != "MISS" {
+			t.Fatalf("%q: got %s, want MISS", language, rec.Header().Get(cacheStatusHeader))
+		}
+	}
+	// every variant is still cached, none evicted the others
+	for _, language := range []string{"en", "de", "", "en"} {
+		rec := getCached(h, language)
+		if rec.Header().Get(cacheStatusHeader) != "HIT" || rec.Body.String() != language {
+			t.Errorf("%q: got %s with %q", language, rec.Header().Get(cacheStatusHeader), rec.Body.String())
+		}
+	}
+	if n := atomic.LoadInt64(requests); n != 3 {
+		t.Errorf("upstream got %d requests, want 3", n)
+	}
+
+	// purging the URI purges its variants
+	if _, err := h.Backends["/cached"].purgeCache("/cached", false); err != nil {
+		t.Fatal(err)
+	}
+	if rec := getCached(h, "de"); rec.Header().Get(cacheStatusHeader) != "MISS" {
+		t.Errorf("got %s after a purge, want MISS", rec.Header().Get(cacheStatusHeader))
+	}
+}
+
+func TestCacheDiskStore(t *testing.T) {
+	config := &CacheConfig{Dir: t.TempDir(), MaxBytes: 1 << 20, MaxDiskBytes: 1 << 20}
+	c, err := newResponseCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "/k" + strconv.Itoa(i%4)
+			for j := 0; j < 50; j++ {
+				c.set(&cacheEntry{Key: key, Status: 200, Body: []byte(key), Stored: time.Now()})
+				// other goroutines purge /k3 at any time
+				if e, ok := c.get(key); (!ok && key != "/k3") || (ok && e.Key != key) {
+					t.Errorf("%s: got %v %v", key, e, ok)
+				}
+				if j%10 == 0 {
+					c.purge("/k3", false)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.purge("/k3", false)
+
+	// a restarted cache finds the entries on disk, but not the purged one
+	restarted, err := newResponseCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		key := "/k" + strconv.Itoa(i)
+		if e, ok := restarted.get(key); !ok || string(e.Body) != key {
+			t.Errorf("%s: not read back from disk", key)
+		}
+	}
+	if _, ok := restarted.get("/k3"); ok {
+		t.Error("purged entry came back from disk")
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(config.Dir, "*.tmp")); len(tmps) != 0 {
+		t.Errorf("left temporary files %v", tmps)
+	}
+}
+
+func TestCacheWithCookieAffinity(t *testing.T) {
+	h := newTestProxy(t)
+	var requests int64
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Query().Get("session") != "" {
+			w.Header().Add("Set-Cookie", "session=1")
+		}
+	})
+	if err := h.RegisterBackend(&Backend{
+		NamedRoute: "/cached",
+		Cache:      &CacheConfig{},
+		Affinity:   &Affinity{Mode: AffinityCookie},
+		Targets:    []*Target{target},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// holler's own affinity cookie doesn't make the response uncacheable,
+	// and isn't handed to other clients from the cache
+	rec := serve(h, httptest.NewRequest("GET", "/cached", nil))
+	if rec.Header().Get(cacheStatusHeader) != "MISS" || len(rec.Header()["Set-Cookie"]) != 1 {
+		t.Fatalf("got %s with cookies %q", rec.Header().Get(cacheStatusHeader), rec.Header()["Set-Cookie"])
+	}
+	rec = serve(h, httptest.NewRequest("GET", "/cached", nil))
+	if rec.Header().Get(cacheStatusHeader) != "HIT" || len(rec.Header()["Set-Cookie"]) != 0 {
+		t.Errorf("got %s with cookies %q, want a HIT without cookies", rec.Header().Get(cacheStatusHeader), rec.Header()["Set-Cookie"])
+	}
+
+	// cookies the upstream sets still keep a response out of the cache
+	for i := 0; i < 2; i++ {
+		serve(h, httptest.NewRequest("GET", "/cached?session=1", nil))
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("upstream got %d requests, want 3", n)
+	}
+}
@@ -0,0 +1,319 @@
+package holler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response. Exported fields are persisted by the disk
+// store. Entries with VaryBy are no response, they name the request headers
+// the variants stored for the request URI vary by.
+type cacheEntry struct {
+	Key                  string
+	Status               int
+	Header               http.Header
+	Body                 []byte
+	Stored               time.Time
+	InitialAge           time.Duration
+	FreshFor             time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	Vary                 map[string]string
+	VaryBy               []string
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, values := range e.Header {
+		n += int64(len(k))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.FreshFor
+}
+
+// staleFor returns how long past its freshness lifetime the entry is.
+func (e *cacheEntry) staleFor(now time.Time) time.Duration {
+	return e.age(now) - e.FreshFor
+}
+
+// lru is a map bounded by the summed size of its values, evicting the least
+// recently used.
+type lru struct {
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	items    map[string]*list.Element
+	onEvict  func(key string)
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	value interface{}
+}
+
+func newLRU(maxBytes int64, onEvict func(string)) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+func (l *lru) get(key string) (interface{}, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (l *lru) add(key string, value interface{}, size int64) {
+	l.remove(key)
+	if size > l.maxBytes {
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size, value: value})
+	l.bytes += size
+	for l.bytes > l.maxBytes {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		if l.onEvict != nil {
+			l.onEvict(oldest.key)
+		}
+	}
+}
+
+func (l *lru) remove(key string) bool {
+	e, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(e)
+	delete(l.items, key)
+	l.bytes -= e.Value.(*lruItem).size
+	return true
+}
+
+// responseCache keeps entries in a memory LRU and, when configured, behind it
+// in a directory of gob encoded files with its own size bound. Files are read
+// and written without holding the lock, only renamed and removed under it.
+// writes numbers the latest write of each key, so a write that lost to a
+// newer one or to a purge is dropped.
+type responseCache struct {
+	memory *lru
+	dir    string
+	disk   *lru
+	writes map[string]uint64
+	seq    uint64
+	sync.Mutex
+}
+
+func newResponseCache(config *CacheConfig) (*responseCache, error) {
+	c := &responseCache{memory: newLRU(config.MaxBytes, nil), writes: make(map[string]uint64)}
+	if len(config.Dir) == 0 {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	c.dir = config.Dir
+	c.disk = newLRU(config.MaxDiskBytes, func(key string) {
+		os.Remove(c.path(key))
+	})
+
+	// index whatever a previous run left behind, oldest first so the LRU
+	// order roughly survives restarts
+	if tmps, err := filepath.Glob(filepath.Join(config.Dir, "*.tmp")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(config.Dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*cacheEntry
+	for _, file := range files {
+		e, err := readCacheFile(file)
+		if err != nil {
+			os.Remove(file)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Stored.Before(entries[j].Stored) })
+	for _, e := range entries {
+		c.disk.add(e.Key, nil, e.size())
+	}
+	return c, nil
+}
+
+func (c *responseCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.Lock()
+	if v, ok := c.memory.get(key); ok {
+		c.Unlock()
+		return v.(*cacheEntry), true
+	}
+	if c.disk == nil {
+		c.Unlock()
+		return nil, false
+	}
+	if _, ok := c.disk.get(key); !ok {
+		c.Unlock()
+		return nil, false
+	}
+	c.Unlock()
+
+	e, err := readCacheFile(c.path(key))
+
+	c.Lock()
+	defer c.Unlock()
+	if v, ok := c.memory.get(key); ok {
+		// set while the file was read
+		return v.(*cacheEntry), true
+	}
+	if _, ok := c.disk.items[key]; !ok {
+		// purged or evicted while the file was read
+		return nil, false
+	}
+	if err != nil || e.Key != key {
+		c.disk.remove(key)
+		return nil, false
+	}
+	c.memory.add(key, e, e.size())
+	return e, true
+}
+
+func (c *responseCache) set(e *cacheEntry) {
+	c.Lock()
+	c.memory.add(e.Key, e, e.size())
+	if c.disk == nil {
+		c.Unlock()
+		return
+	}
+	c.seq++
+	seq := c.seq
+	c.writes[e.Key] = seq
+	c.Unlock()
+
+	tmp, err := writeCacheFile(c.dir, e)
+	if err != nil {
+		c.Lock()
+		if c.writes[e.Key] == seq {
+			delete(c.writes, e.Key)
+		}
+		c.Unlock()
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.writes[e.Key] != seq {
+		os.Remove(tmp)
+		return
+	}
+	delete(c.writes, e.Key)
+	if err := os.Rename(tmp, c.path(e.Key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	c.disk.add(e.Key, nil, e.size())
+}
+
+// purge removes key and its variants, or every key starting with it when
+// prefix is set, and returns the number of entries removed.
+func (c *responseCache) purge(key string, prefix bool) int {
+	c.Lock()
+	defer c.Unlock()
+
+	matches := func(k string) bool {
+		return k == key || strings.HasPrefix(k, key+"\n") || (prefix && strings.HasPrefix(k, key))
+	}
+	keys := map[string]bool{}
+	for _, l := range []*lru{c.memory, c.disk} {
+		if l == nil {
+			continue
+		}
+		for k := range l.items {
+			if matches(k) {
+				keys[k] = true
+			}
+		}
+	}
+
+	// drop writes still in flight, so they don't bring purged entries back
+	for k := range c.writes {
+		if matches(k) {
+			delete(c.writes, k)
+		}
+	}
+	for k := range keys {
+		c.memory.remove(k)
+		if c.disk != nil && c.disk.remove(k) {
+			os.Remove(c.path(k))
+		}
+	}
+	return len(keys)
+}
+
+func readCacheFile(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e := &cacheEntry{}
+	if err := gob.NewDecoder(f).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// writeCacheFile writes e to a new temporary file in dir and returns its
+// path, to be renamed into place so readers never see a partial entry.
+func writeCacheFile(dir string, e *cacheEntry) (string, error) {
+	f, err := ioutil.TempFile(dir, "*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if err := gob.NewEncoder(f).Encode(e); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
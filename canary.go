@@ -0,0 +1,271 @@
+package holler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultCanaryInterval     = 60
+	defaultCanaryStepWeight   = 10
+	defaultCanaryMaxWeight    = 100
+	defaultCanaryMinRequests  = 20
+	defaultCanaryMaxErrorIncr = 1
+	defaultCanaryMaxLatency   = 1.5
+	defaultCanaryMinLatency   = 5
+	canaryDecisionLogSize     = 100
+	canaryStatusProgressing   = "progressing"
+	canaryStatusPromoted      = "promoted"
+	canaryStatusRolledBack    = "rolled_back"
+	canaryActionStep          = "step"
+	canaryActionHold          = "hold"
+	canaryActionPromote       = "promote"
+	canaryActionRollback      = "rollback"
+)
+
+// CanaryConfig analyzes the Group target group against the Baseline group
+// every Interval seconds (default 60) and moves traffic between the two.
+// When both saw MinRequests (default 20) requests, the canary is rolled back
+// to weight 0 if its 5xx rate is more than MaxErrorRateIncrease percentage
+// points (default 1) above the baseline's, or its mean latency more than
+// MaxLatencyRatio times (default 1.5) and MinLatencyIncreaseMS (default 5)
+// above the baseline's. Otherwise its share goes
+// up by StepWeight percent (default 10) until it reaches MaxWeight (default
+// 100) and is promoted. Weights are percentages, the baseline getting the
+// rest; other groups keep theirs.
+type CanaryConfig struct {
+	Group                string  `json:"group"`
+	Baseline             string  `json:"baseline"`
+	Interval             int     `json:"interval,omitempty"`
+	StepWeight           int     `json:"step_weight,omitempty"`
+	MaxWeight            int     `json:"max_weight,omitempty"`
+	MinRequests          int     `json:"min_requests,omitempty"`
+	MaxErrorRateIncrease float64 `json:"max_error_rate_increase,omitempty"`
+	MaxLatencyRatio      float64 `json:"max_latency_ratio,omitempty"`
+	MinLatencyIncreaseMS float64 `json:"min_latency_increase_ms,omitempty"`
+}
+
+// CanaryStats are the requests a target group served during one analysis
+// window.
+type CanaryStats struct {
+	Requests      int     `json:"requests"`
+	ErrorRate     float64 `json:"error_rate"`
+	MeanLatencyMS float64 `json:"mean_latency_ms"`
+}
+
+// CanaryDecision is one entry of the canary decision log.
+type CanaryDecision struct {
+	Time     time.Time   `json:"time"`
+	Action   string      `json:"action"`
+	Reason   string      `json:"reason"`
+	From     int         `json:"from_weight"`
+	To       int         `json:"to_weight"`
+	Canary   CanaryStats `json:"canary"`
+	Baseline CanaryStats `json:"baseline"`
+}
+
+// CanaryStatus is what the admin API shows of a canary analysis.
+type CanaryStatus struct {
+	Status    string            `json:"status"`
+	Weight    int               `json:"weight"`
+	Decisions []*CanaryDecision `json:"decisions"`
+}
+
+type canaryWindow struct {
+	requests int
+	errors   int
+	latency  time.Duration
+}
+
+func (w canaryWindow) stats() CanaryStats {
+	s := CanaryStats{Requests: w.requests}
+	if w.requests != 0 {
+		s.ErrorRate = 100 * float64(w.errors) / float64(w.requests)
+		s.MeanLatencyMS = float64(w.latency) / float64(w.requests) / float64(time.Millisecond)
+	}
+	return s
+}
+
+type canary struct {
+	config   *CanaryConfig
+	backend  *Backend
+	groups   map[*Target]string
+	windows  map[string]*canaryWindow
+	status   string
+	log      []*CanaryDecision
+	stop     chan struct{}
+	stopOnce sync.Once
+	sync.Mutex
+}
+
+func newCanary(b *Backend) (*canary, error) {
+	config := b.Canary
+	if !b.isHTTP() {
+		return nil, errors.New("canary analysis requires an http backend")
+	}
+	canaryGroup, baseline := b.group(config.Group), b.group(config.Baseline)
+	if canaryGroup == nil || baseline == nil || canaryGroup == baseline {
+		return nil, errors.New("canary group and baseline must be two of the backend's target groups")
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultCanaryInterval
+	}
+	if config.StepWeight <= 0 {
+		config.StepWeight = defaultCanaryStepWeight
+	}
+	if config.MaxWeight <= 0 || config.MaxWeight > 100 {
+		config.MaxWeight = defaultCanaryMaxWeight
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultCanaryMinRequests
+	}
+	if config.MaxErrorRateIncrease <= 0 {
+		config.MaxErrorRateIncrease = defaultCanaryMaxErrorIncr
+	}
+	if config.MaxLatencyRatio <= 0 {
+		config.MaxLatencyRatio = defaultCanaryMaxLatency
+	}
+	if config.MinLatencyIncreaseMS <= 0 {
+		config.MinLatencyIncreaseMS = defaultCanaryMinLatency
+	}
+
+	c := &canary{
+		config:  config,
+		backend: b,
+		groups:  map[*Target]string{},
+		windows: map[string]*canaryWindow{
+			config.Group:    {},
+			config.Baseline: {},
+		},
+		status: canaryStatusProgressing,
+		stop:   make(chan struct{}),
+	}
+	for _, g := range []*TargetGroup{canaryGroup, baseline} {
+		for _, t := range g.Targets {
+			c.groups[t] = g.Name
+		}
+	}
+	return c, nil
+}
+
+// record counts a finished request towards the window of its target's group.
+func (c *canary) record(state *proxyState) {
+	name, ok := c.groups[state.target]
+	if !ok {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	w := c.windows[name]
+	w.requests++
+	if state.status >= 500 {
+		w.errors++
+	}
+	w.latency += state.duration
+}
+
+// run analyzes the canary every interval until it is promoted, rolled back or
+// stopped.
+func (c *canary) run(log *logrus.Entry) {
+	ticker := time.NewTicker(time.Duration(c.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			d := c.analyze(now)
+			log.Infof("canary %s for backend %s: %s %d%% -> %d%% (%s)", c.config.Group, c.backend.NamedRoute, d.Action, d.From, d.To, d.Reason)
+			if d.Action == canaryActionPromote || d.Action == canaryActionRollback {
+				return
+			}
+		}
+	}
+}
+
+// analyze closes the current window, decides on it and applies the decision.
+func (c *canary) analyze(now time.Time) *CanaryDecision {
+	c.Lock()
+	canaryStats := c.windows[c.config.Group].stats()
+	baselineStats := c.windows[c.config.Baseline].stats()
+	c.windows[c.config.Group] = &canaryWindow{}
+	c.windows[c.config.Baseline] = &canaryWindow{}
+	c.Unlock()
+
+	weight := c.weight()
+	d := &CanaryDecision{
+		Time:     now,
+		From:     weight,
+		To:       weight,
+		Canary:   canaryStats,
+		Baseline: baselineStats,
+	}
+
+	switch {
+	case canaryStats.Requests < c.config.MinRequests || baselineStats.Requests < c.config.MinRequests:
+		d.Action, d.Reason = canaryActionHold, "insufficient requests"
+	case canaryStats.ErrorRate-baselineStats.ErrorRate > c.config.MaxErrorRateIncrease:
+		d.Action, d.Reason, d.To = canaryActionRollback, "error rate regression", 0
+	case canaryStats.MeanLatencyMS > baselineStats.MeanLatencyMS*c.config.MaxLatencyRatio &&
+		canaryStats.MeanLatencyMS-baselineStats.MeanLatencyMS > c.config.MinLatencyIncreaseMS:
+		d.Action, d.Reason, d.To = canaryActionRollback, "latency regression", 0
+	default:
+		d.Action, d.Reason, d.To = canaryActionStep, "canary within thresholds", weight+c.config.StepWeight
+		if d.To >= c.config.MaxWeight {
+			d.Action, d.Reason, d.To = canaryActionPromote, "max weight reached", c.config.MaxWeight
+		}
+	}
+
+	if d.To != d.From {
+		if err := c.backend.SetGroupWeights(map[string]int{
+			c.config.Group:    d.To,
+			c.config.Baseline: 100 - d.To,
+		}); err != nil {
+			d.Action, d.Reason, d.To = canaryActionHold, err.Error(), d.From
+		}
+	}
+
+	c.Lock()
+	switch d.Action {
+	case canaryActionPromote:
+		c.status = canaryStatusPromoted
+	case canaryActionRollback:
+		c.status = canaryStatusRolledBack
+	}
+	c.log = append(c.log, d)
+	if len(c.log) > canaryDecisionLogSize {
+		c.log = c.log[len(c.log)-canaryDecisionLogSize:]
+	}
+	c.Unlock()
+	return d
+}
+
+// weight returns the canary's current share of the canary and baseline
+// traffic in percent.
+func (c *canary) weight() int {
+	weights := c.backend.groupWeights()
+	total := weights[c.config.Group] + weights[c.config.Baseline]
+	if total == 0 {
+		return 0
+	}
+	return 100 * weights[c.config.Group] / total
+}
+
+func (c *canary) snapshot() *CanaryStatus {
+	c.Lock()
+	defer c.Unlock()
+	return &CanaryStatus{
+		Status:    c.status,
+		Weight:    c.weight(),
+		Decisions: append([]*CanaryDecision(nil), c.log...),
+	}
+}
+
+func (c *canary) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
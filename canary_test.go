@@ -0,0 +1,97 @@
+package holler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// canaryBackend registers a backend with a stable and a canary group at the
+// given canary weight, whose analysis only runs when the test calls it.
+func canaryBackend(t *testing.T, weight int) *Backend {
+	h := newTestProxy(t)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	b := &Backend{
+		NamedRoute: "/canary",
+		Groups: []*TargetGroup{
+			{Name: "stable", Weight: 100 - weight, Targets: []*Target{upstream(t, ok)}},
+			{Name: "canary", Weight: weight, Targets: []*Target{upstream(t, ok)}},
+		},
+		Canary: &CanaryConfig{Group: "canary", Baseline: "stable", Interval: 3600},
+	}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// window fills a canary window with requests, of which errors failed, taking
+// latencyMS each.
+func window(requests, errors int, latencyMS float64) *canaryWindow {
+	return &canaryWindow{
+		requests: requests,
+		errors:   errors,
+		latency:  time.Duration(float64(requests) * latencyMS * float64(time.Millisecond)),
+	}
+}
+
+func TestCanaryDecisions(t *testing.T) {
+	for _, c := range []struct {
+		name             string
+		weight           int
+		canary, baseline *canaryWindow
+		action           string
+		to               int
+		status           string
+	}{
+		{"too few canary requests", 5, window(19, 0, 10), window(500, 0, 10), canaryActionHold, 5, canaryStatusProgressing},
+		{"too few baseline requests", 5, window(100, 0, 10), window(10, 0, 10), canaryActionHold, 5, canaryStatusProgressing},
+		{"healthy", 5, window(100, 0, 10), window(500, 0, 10), canaryActionStep, 15, canaryStatusProgressing},
+		{"error rate within bounds", 5, window(200, 1, 10), window(200, 0, 10), canaryActionStep, 15, canaryStatusProgressing},
+		{"error rate regression", 5, window(100, 2, 10), window(500, 0, 10), canaryActionRollback, 0, canaryStatusRolledBack},
+		{"latency regression", 5, window(100, 0, 30), window(500, 0, 10), canaryActionRollback, 0, canaryStatusRolledBack},
+		{"slower by a small margin", 5, window(100, 0, 4), window(500, 0, 1), canaryActionStep, 15, canaryStatusProgressing},
+		{"slower by a small ratio", 5, window(100, 0, 140), window(500, 0, 100), canaryActionStep, 15, canaryStatusProgressing},
+		{"max weight", 95, window(100, 0, 10), window(500, 0, 10), canaryActionPromote, 100, canaryStatusPromoted},
+	} {
+		b := canaryBackend(t, c.weight)
+		b.canary.windows["canary"] = c.canary
+		b.canary.windows["stable"] = c.baseline
+
+		d := b.canary.analyze(time.Now())
+		if d.Action != c.action || d.From != c.weight || d.To != c.to {
+			t.Errorf("%s: got %s %d -> %d (%s), want %s %d -> %d", c.name, d.Action, d.From, d.To, d.Reason, c.action, c.weight, c.to)
+		}
+		if w := b.groupWeights(); w["canary"] != c.to || w["stable"] != 100-c.to {
+			t.Errorf("%s: group weights are %v, want canary at %d", c.name, w, c.to)
+		}
+		if s := b.canary.snapshot(); s.Status != c.status || len(s.Decisions) != 1 {
+			t.Errorf("%s: got status %s with %d decisions, want %s with 1", c.name, s.Status, len(s.Decisions), c.status)
+		}
+	}
+}
+
+func TestCanaryWindows(t *testing.T) {
+	b := canaryBackend(t, 10)
+	canaryTarget, stableTarget := b.Groups[1].Targets[0], b.Groups[0].Targets[0]
+
+	for i := 0; i < 4; i++ {
+		b.canary.record(&proxyState{target: canaryTarget, status: 200, duration: 20 * time.Millisecond})
+	}
+	b.canary.record(&proxyState{target: canaryTarget, status: 502, duration: 20 * time.Millisecond})
+	b.canary.record(&proxyState{target: stableTarget, status: 200, duration: 10 * time.Millisecond})
+	b.canary.record(&proxyState{target: &Target{URL: "http://elsewhere"}, status: 500})
+
+	d := b.canary.analyze(time.Now())
+	if d.Canary.Requests != 5 || d.Canary.ErrorRate != 20 || d.Canary.MeanLatencyMS != 20 {
+		t.Errorf("got canary stats %+v", d.Canary)
+	}
+	if d.Baseline.Requests != 1 || d.Baseline.ErrorRate != 0 || d.Baseline.MeanLatencyMS != 10 {
+		t.Errorf("got baseline stats %+v", d.Baseline)
+	}
+
+	// every analysis starts a new window
+	if d := b.canary.analyze(time.Now()); d.Canary.Requests != 0 || d.Baseline.Requests != 0 {
+		t.Errorf("windows were not reset, got %d and %d requests", d.Canary.Requests, d.Baseline.Requests)
+	}
+}
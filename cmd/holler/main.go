@@ -12,7 +12,12 @@ var (
 	VERSION  = "unset"
 	REVISION = "unset"
 
-	versionFlag = flag.Bool("version", false, "Print holler version")
+	versionFlag         = flag.Bool("version", false, "Print holler version")
+	accessLogFlag       = flag.String("access-log", "", "Write access logs to this file, - for stdout")
+	accessLogFormatFlag = flag.String("access-log-format", "json", "Access log format: json, common or combined")
+	otlpEndpointFlag    = flag.String("otlp-endpoint", "", "Export traces to this OTLP/HTTP traces URL")
+	traceSampleFlag     = flag.Float64("trace-sample-ratio", 1, "Fraction of new traces to sample")
+	redisFlag           = flag.String("ratelimit-redis", "", "Share rate limits through the Redis server at this address")
 )
 
 func main() {
@@ -22,7 +27,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	myHoller, err := holler.New()
+	options := []holler.Option{}
+	if len(*accessLogFlag) != 0 {
+		options = append(options, holler.HollerAccessLog(holler.AccessLogConfig{
+			Format: *accessLogFormatFlag,
+			Path:   *accessLogFlag,
+		}))
+	}
+
+	if len(*otlpEndpointFlag) != 0 {
+		options = append(options, holler.HollerTracing(holler.TracingConfig{
+			Endpoint:    *otlpEndpointFlag,
+			SampleRatio: traceSampleFlag,
+		}))
+	}
+
+	if len(*redisFlag) != 0 {
+		store, err := holler.NewRedisStore(holler.RedisConfig{Addr: *redisFlag})
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, holler.HollerRateLimitStore(store))
+	}
+
+	myHoller, err := holler.New(options...)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,201 @@
+package holler
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCoalesceMaxWaiters = 1000
+	defaultCoalesceMaxWait    = 5000
+	defaultCoalesceMaxBody    = 1 << 20
+)
+
+// coalesceSeparate are the request headers that always separate flights
+// whatever the response varies by, as they make it partial, conditional or
+// for one client only.
+var coalesceSeparate = []string{
+	"Authorization", "Cookie", "If-Modified-Since", "If-None-Match", "Range",
+}
+
+// CoalesceConfig collapses identical concurrent GET and HEAD requests into a
+// single upstream request whose response is fanned out to every waiter.
+// Requests are identical when their method and URL match, along with the
+// request headers named in the response's Vary. Conditional, range and
+// credentialed requests, and any VaryHeaders, only join requests with the
+// same values. At most MaxWaiters (default 1000) join one upstream request,
+// each for up to MaxWaitMS (default 5000) milliseconds, and responses over
+// MaxBodyBytes (default 1MB) are not shared; requests that don't join one go
+// upstream on their own.
+type CoalesceConfig struct {
+	VaryHeaders  []string `json:"vary_headers,omitempty"`
+	MaxWaiters   int      `json:"max_waiters,omitempty"`
+	MaxWaitMS    int      `json:"max_wait_ms,omitempty"`
+	MaxBodyBytes int64    `json:"max_body_bytes,omitempty"`
+}
+
+type coalescer struct {
+	config  *CoalesceConfig
+	vary    []string
+	flights map[string]*flight
+	sync.Mutex
+}
+
+// flight is one upstream request shared by its leader and waiters.
+type flight struct {
+	done    chan struct{}
+	waiters int
+	request http.Header
+	// set before done is closed
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+	vary   []string
+}
+
+func newCoalescer(config *CoalesceConfig) *coalescer {
+	if config.MaxWaiters <= 0 {
+		config.MaxWaiters = defaultCoalesceMaxWaiters
+	}
+	if config.MaxWaitMS <= 0 {
+		config.MaxWaitMS = defaultCoalesceMaxWait
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = defaultCoalesceMaxBody
+	}
+
+	vary := append([]string(nil), coalesceSeparate...)
+	for _, name := range config.VaryHeaders {
+		vary = append(vary, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(vary)
+
+	return &coalescer{
+		config:  config,
+		vary:    vary,
+		flights: make(map[string]*flight),
+	}
+}
+
+func (c *coalescer) key(r *http.Request) string {
+	parts := []string{r.Method, r.Host, r.URL.RequestURI()}
+	for _, name := range c.vary {
+		parts = append(parts, strings.Join(r.Header[name], ","))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// coalesce wraps the handler of an http backend with request coalescing.
+func (h *HollerProxy) coalesce(inner http.Handler, b *Backend) http.Handler {
+	if b.coalescer == nil {
+		return inner
+	}
+	c := b.coalescer
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		key := c.key(r)
+		c.Lock()
+		f, ok := c.flights[key]
+		if !ok {
+			f = &flight{done: make(chan struct{}), request: cloneHeader(r.Header)}
+			c.flights[key] = f
+			c.Unlock()
+			h.metrics.coalesced.add(1, b.NamedRoute, "leader")
+			c.lead(w, r, inner, key, f)
+			return
+		}
+		if f.waiters >= c.config.MaxWaiters {
+			c.Unlock()
+			h.metrics.coalesced.add(1, b.NamedRoute, "overflow")
+			inner.ServeHTTP(w, r)
+			return
+		}
+		f.waiters++
+		c.Unlock()
+
+		timer := time.NewTimer(time.Duration(c.config.MaxWaitMS) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-f.done:
+		case <-timer.C:
+			h.metrics.coalesced.add(1, b.NamedRoute, "timeout")
+			inner.ServeHTTP(w, r)
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if !f.ok {
+			h.metrics.coalesced.add(1, b.NamedRoute, "failed")
+			inner.ServeHTTP(w, r)
+			return
+		}
+		if !f.matches(r) {
+			h.metrics.coalesced.add(1, b.NamedRoute, "vary")
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		h.metrics.coalesced.add(1, b.NamedRoute, "joined")
+		header := w.Header()
+		for k, v := range f.header {
+			header[k] = append([]string(nil), v...)
+		}
+		w.WriteHeader(f.status)
+		w.Write(f.body)
+	})
+}
+
+// lead makes the upstream request for a flight, streaming it to the leader's
+// client while keeping a copy for the waiters. If the leader's client goes
+// away, or the response is too big or sets cookies, the waiters are told to
+// make their own requests.
+func (c *coalescer) lead(w http.ResponseWriter, r *http.Request, inner http.Handler, key string, f *flight) {
+	var (
+		cw       = newCacheWriter(w, c.config.MaxBodyBytes, nil)
+		finished bool
+	)
+	defer func() {
+		c.Lock()
+		delete(c.flights, key)
+		c.Unlock()
+
+		f.ok = finished && cw.status != 0 && !cw.tooBig &&
+			r.Context().Err() == nil && len(cw.header["Set-Cookie"]) == 0
+		f.status, f.header, f.body = cw.status, cw.header, cw.body.Bytes()
+		for _, line := range cw.header["Vary"] {
+			for _, name := range strings.Split(line, ",") {
+				if name = strings.TrimSpace(name); name == "*" {
+					f.ok = false
+				} else if len(name) != 0 {
+					f.vary = append(f.vary, http.CanonicalHeaderKey(name))
+				}
+			}
+		}
+		close(f.done)
+	}()
+
+	inner.ServeHTTP(cw, r)
+	finished = true
+}
+
+// matches reports whether r asks for the same variant of the response as the
+// leader did, going by the headers the response varies by.
+func (f *flight) matches(r *http.Request) bool {
+	for _, name := range f.vary {
+		if strings.Join(r.Header[name], ",") != strings.Join(f.request[name], ",") {
+			return false
+		}
+	}
+	return true
+}
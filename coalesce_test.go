@@ -0,0 +1,179 @@
+package holler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// coalescedProxy registers a backend at /coalesced with config. Its target
+// holds the first request until release is closed and counts the requests
+// it gets in hits.
+func coalescedProxy(t *testing.T, config *CoalesceConfig, handler http.HandlerFunc) (h *HollerProxy, b *Backend, hits *int32, release chan struct{}) {
+	h = newTestProxy(t)
+	hits, release = new(int32), make(chan struct{})
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(hits, 1) == 1 {
+			<-release
+		}
+		handler(w, r)
+	})
+	b = &Backend{NamedRoute: "/coalesced", Coalesce: config, Targets: []*Target{target}}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return h, b, hits, release
+}
+
+func shared(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("shared"))
+}
+
+// waitFor polls until cond holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+	}
+}
+
+// waiting returns the number of requests waiting on flights of c.
+func waiting(c *coalescer) int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _, f := range c.flights {
+		n += f.waiters
+	}
+	return n
+}
+
+// get serves a GET of /coalesced with header in the background.
+func get(h *HollerProxy, header http.Header) chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	r := httptest.NewRequest("GET", "/coalesced", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	go func() { done <- serve(h, r) }()
+	return done
+}
+
+func TestCoalesceFanOut(t *testing.T) {
+	h, b, hits, release := coalescedProxy(t, &CoalesceConfig{}, shared)
+
+	var responses []chan *httptest.ResponseRecorder
+	responses = append(responses, get(h, nil))
+	waitFor(t, "the leader", func() bool { return atomic.LoadInt32(hits) == 1 })
+	for i := 0; i < 9; i++ {
+		responses = append(responses, get(h, nil))
+	}
+	waitFor(t, "the waiters", func() bool { return waiting(b.coalescer) == 9 })
+	close(release)
+
+	for i, done := range responses {
+		if rec := <-done; rec.Code != http.StatusOK || rec.Body.String() != "shared" {
+			t.Errorf("request %d got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("10 identical requests made %d upstream requests, want 1", n)
+	}
+}
+
+func TestCoalesceMaxWaiters(t *testing.T) {
+	h, b, hits, release := coalescedProxy(t, &CoalesceConfig{MaxWaiters: 2}, shared)
+
+	leader := get(h, nil)
+	waitFor(t, "the leader", func() bool { return atomic.LoadInt32(hits) == 1 })
+	waiters := []chan *httptest.ResponseRecorder{get(h, nil), get(h, nil)}
+	waitFor(t, "the waiters", func() bool { return waiting(b.coalescer) == 2 })
+
+	// the third waiter is over the cap and goes upstream right away
+	if rec := <-get(h, nil); rec.Code != http.StatusOK || atomic.LoadInt32(hits) != 2 {
+		t.Errorf("request over the waiter cap got %d after %d upstream requests", rec.Code, atomic.LoadInt32(hits))
+	}
+	close(release)
+	<-leader
+	for _, done := range waiters {
+		<-done
+	}
+	if n := atomic.LoadInt32(hits); n != 2 {
+		t.Errorf("got %d upstream requests, want 2", n)
+	}
+}
+
+func TestCoalesceMaxWait(t *testing.T) {
+	h, _, hits, release := coalescedProxy(t, &CoalesceConfig{MaxWaitMS: 50}, shared)
+	defer close(release)
+
+	get(h, nil)
+	waitFor(t, "the leader", func() bool { return atomic.LoadInt32(hits) == 1 })
+
+	start := time.Now()
+	rec := <-get(h, nil)
+	if elapsed := time.Since(start); rec.Code != http.StatusOK || elapsed < 50*time.Millisecond {
+		t.Errorf("waiter got %d after %s, want its own response after 50ms", rec.Code, elapsed)
+	}
+	if n := atomic.LoadInt32(hits); n != 2 {
+		t.Errorf("got %d upstream requests, want 2", n)
+	}
+}
+
+func TestCoalesceVary(t *testing.T) {
+	h, b, hits, release := coalescedProxy(t, &CoalesceConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+
+	leader := get(h, http.Header{"Accept-Language": {"en"}, "Accept": {"text/html"}})
+	waitFor(t, "the leader", func() bool { return atomic.LoadInt32(hits) == 1 })
+	// the response only varies by language, so a different Accept shares it
+	same := get(h, http.Header{"Accept-Language": {"en"}, "Accept": {"*/*"}})
+	other := get(h, http.Header{"Accept-Language": {"de"}})
+	waitFor(t, "the waiters", func() bool { return waiting(b.coalescer) == 2 })
+	close(release)
+
+	for _, c := range []struct {
+		done chan *httptest.ResponseRecorder
+		want string
+	}{{leader, "en"}, {same, "en"}, {other, "de"}} {
+		if rec := <-c.done; rec.Body.String() != c.want {
+			t.Errorf("got %q, want %q", rec.Body.String(), c.want)
+		}
+	}
+	if n := atomic.LoadInt32(hits); n != 2 {
+		t.Errorf("got %d upstream requests, want 2", n)
+	}
+}
+
+func TestCoalesceCanceledWaiter(t *testing.T) {
+	h, b, hits, release := coalescedProxy(t, &CoalesceConfig{}, shared)
+
+	leader := get(h, nil)
+	waitFor(t, "the leader", func() bool { return atomic.LoadInt32(hits) == 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- serve(h, httptest.NewRequest("GET", "/coalesced", nil).WithContext(ctx)) }()
+	waitFor(t, "the waiter", func() bool { return waiting(b.coalescer) == 1 })
+	cancel()
+	<-done
+	close(release)
+	<-leader
+
+	body := scrape(t, h)
+	for _, line := range []string{
+		`holler_requests_total{backend="/coalesced",target="",code="4xx"} 1`,
+		`holler_requests_total{backend="/coalesced",target="` + b.Targets[0].URL + `",code="2xx"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("scrape is missing %q", line)
+		}
+	}
+}
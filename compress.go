@@ -0,0 +1,506 @@
+package holler
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultCompressionMinBytes = 1024
+
+var (
+	defaultCompressionEncodings = []string{"br", "zstd", "gzip", "deflate"}
+	defaultCompressionMimeTypes = []string{
+		"text/*",
+		"application/json",
+		"application/*+json",
+		"application/javascript",
+		"application/xml",
+		"application/*+xml",
+		"image/svg+xml",
+	}
+)
+
+// Encoding implements one HTTP content coding. NewWriter compresses into w at
+// level, where 0 asks for the coding's default; NewReader decompresses r and
+// may be nil for codings holler should never decode.
+type Encoding struct {
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	encodings   = map[string]Encoding{}
+	encodingsMu sync.RWMutex
+)
+
+// RegisterEncoding makes a content coding available to backend compression
+// under name, as it appears in Accept-Encoding. br, zstd, gzip and deflate are
+// built in; programs embedding holler can register others, or replace them,
+// before registering backends that use them.
+func RegisterEncoding(name string, encoding Encoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings[strings.ToLower(name)] = encoding
+}
+
+func lookupEncoding(name string) (Encoding, bool) {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	encoding, ok := encodings[name]
+	return encoding, ok
+}
+
+func init() {
+	RegisterEncoding("gzip", Encoding{
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+	// HTTP's deflate is the zlib format, not raw deflate.
+	RegisterEncoding("deflate", Encoding{
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = zlib.DefaultCompression
+			}
+			return zlib.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	})
+	RegisterEncoding("br", Encoding{
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = brotli.DefaultCompression
+			}
+			return brotli.NewWriterLevel(w, level), nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(brotli.NewReader(r)), nil
+		},
+	})
+	// zstd encoders and decoders run on the request's goroutine rather than
+	// starting their own.
+	RegisterEncoding("zstd", Encoding{
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			speed := zstd.SpeedDefault
+			if level != 0 {
+				speed = zstd.EncoderLevelFromZstd(level)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	})
+}
+
+// CompressionConfig compresses responses on the fly for clients that accept
+// it. Encodings lists the codings to offer in order of preference, by default
+// br, zstd, gzip and deflate. Level is passed to the encoder, 0 meaning its
+// default. Only responses of at least MinBytes (default 1024) whose
+// Content-Type matches MimeTypes, which may use wildcards like text/* or
+// application/*+json, are compressed. With
+// DecompressUpstream, responses the upstream compressed are decompressed for
+// clients that don't accept their coding.
+type CompressionConfig struct {
+	Encodings          []string `json:"encodings,omitempty"`
+	Level              int      `json:"level,omitempty"`
+	MinBytes           int      `json:"min_bytes,omitempty"`
+	MimeTypes          []string `json:"mime_types,omitempty"`
+	DecompressUpstream bool     `json:"decompress_upstream,omitempty"`
+}
+
+type compressor struct {
+	config    *CompressionConfig
+	encodings []string
+	mimeTypes []string
+}
+
+func newCompressor(config *CompressionConfig) (*compressor, error) {
+	if config.Level < 0 {
+		return nil, errors.New("compression level can not be negative")
+	}
+	if config.MinBytes <= 0 {
+		config.MinBytes = defaultCompressionMinBytes
+	}
+
+	c := &compressor{config: config, mimeTypes: config.MimeTypes}
+	if len(c.mimeTypes) == 0 {
+		c.mimeTypes = defaultCompressionMimeTypes
+	}
+
+	if len(config.Encodings) == 0 {
+		c.encodings = defaultCompressionEncodings
+		return c, nil
+	}
+	for _, name := range config.Encodings {
+		name = strings.ToLower(name)
+		if _, ok := lookupEncoding(name); !ok {
+			return nil, errors.New("unknown compression encoding " + name)
+		}
+		c.encodings = append(c.encodings, name)
+	}
+	return c, nil
+}
+
+// negotiate picks the encoding the client weighs highest, breaking ties by
+// the configured preference. It returns "" when none is acceptable.
+func (c *compressor) negotiate(accept map[string]float64) string {
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, name := range c.encodings {
+		if q := acceptQ(accept, name); q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether the response's media type is on the allowlist.
+func (c *compressor) compressible(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.mimeTypes {
+		pattern = strings.ToLower(pattern)
+		star := strings.Index(pattern, "*")
+		if star < 0 {
+			if mediaType == pattern {
+				return true
+			}
+			continue
+		}
+		prefix, suffix := pattern[:star], pattern[star+1:]
+		if len(mediaType) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAcceptEncoding maps each coding in an Accept-Encoding header to its
+// q-value.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accept := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(name) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accept[name] = q
+	}
+	return accept
+}
+
+func acceptQ(accept map[string]float64, name string) float64 {
+	if q, ok := accept[name]; ok {
+		return q
+	}
+	if name == "gzip" {
+		if q, ok := accept["x-gzip"]; ok {
+			return q
+		}
+	}
+	return accept["*"]
+}
+
+func addVary(header http.Header, name string) {
+	for _, line := range header["Vary"] {
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// weakenETag marks the ETag weak, as the transformed body is no longer
+// byte-for-byte what the upstream tagged.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); len(etag) != 0 && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compress wraps the handler of an http backend with response compression.
+func (h *HollerProxy) compress(inner http.Handler, b *Backend) http.Handler {
+	if b.compressor == nil {
+		return inner
+	}
+	c := b.compressor
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+		cw := &compressWriter{
+			client:   w,
+			c:        c,
+			method:   r.Method,
+			accept:   accept,
+			encoding: c.negotiate(accept),
+		}
+		inner.ServeHTTP(cw, r)
+		if err := cw.finish(); err != nil {
+			h.logFor(r).Warnf("compressing response: %s", err)
+		}
+	})
+}
+
+// compressWriter sits between the proxy and the client. Upstream bodies in a
+// coding the client doesn't accept are first piped through a decoder; plain
+// bodies are then held back until MinBytes are known, and either compressed
+// or passed on as they are.
+type compressWriter struct {
+	client   http.ResponseWriter
+	c        *compressor
+	method   string
+	accept   map[string]float64
+	encoding string
+
+	status   int
+	upgraded bool
+	pending  bool
+	buf      []byte
+	body     io.Writer
+	encoder  io.WriteCloser
+
+	decoder *io.PipeWriter
+	decoded chan struct{}
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.client.Header()
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		cw.upgraded = status == http.StatusSwitchingProtocols
+		cw.client.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	header := cw.client.Header()
+
+	if status == http.StatusNotModified {
+		if len(cw.encoding) != 0 {
+			addVary(header, "Accept-Encoding")
+			weakenETag(header)
+		}
+		cw.pass()
+		return
+	}
+
+	var (
+		bodyless = cw.method == "HEAD" || status == http.StatusNoContent
+		coding   = strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+		decode   *Encoding
+	)
+	if len(coding) != 0 && coding != "identity" {
+		encoding, ok := lookupEncoding(coding)
+		if bodyless || !cw.c.config.DecompressUpstream || acceptQ(cw.accept, coding) > 0 ||
+			!ok || encoding.NewReader == nil {
+			cw.pass()
+			return
+		}
+		addVary(header, "Accept-Encoding")
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		weakenETag(header)
+		decode = &encoding
+	}
+
+	switch {
+	case !cw.c.compressible(header):
+		cw.pass()
+	case bodyless || len(cw.encoding) == 0 || status == http.StatusPartialContent ||
+		len(header.Get("Content-Range")) != 0 || noTransform(header):
+		addVary(header, "Accept-Encoding")
+		cw.pass()
+	default:
+		addVary(header, "Accept-Encoding")
+		if n, err := strconv.Atoi(header.Get("Content-Length")); err == nil && n < cw.c.config.MinBytes {
+			cw.pass()
+		} else {
+			cw.pending = true
+		}
+	}
+
+	if decode != nil {
+		cw.startDecoder(*decode)
+	}
+}
+
+func noTransform(header http.Header) bool {
+	_, ok := cacheControl(header)["no-transform"]
+	return ok
+}
+
+// pass sends the response on uncompressed.
+func (cw *compressWriter) pass() {
+	cw.client.WriteHeader(cw.status)
+	cw.body = cw.client
+}
+
+// start sends the response on compressed, falling back to passing it on if
+// the encoder can't be created.
+func (cw *compressWriter) start() {
+	cw.pending = false
+	encoding, _ := lookupEncoding(cw.encoding)
+	header := cw.client.Header()
+
+	encoder, err := encoding.NewWriter(cw.client, cw.c.config.Level)
+	if err != nil {
+		cw.pass()
+		return
+	}
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	weakenETag(header)
+	cw.client.WriteHeader(cw.status)
+	cw.encoder = encoder
+	cw.body = encoder
+}
+
+func (cw *compressWriter) startDecoder(encoding Encoding) {
+	pr, pw := io.Pipe()
+	cw.decoder = pw
+	cw.decoded = make(chan struct{})
+
+	go func() {
+		defer close(cw.decoded)
+		r, err := encoding.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(plainWriter{cw}, r)
+			r.Close()
+		}
+		pr.CloseWithError(err)
+	}()
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decoder != nil {
+		return cw.decoder.Write(p)
+	}
+	return cw.writePlain(p)
+}
+
+func (cw *compressWriter) writePlain(p []byte) (int, error) {
+	if !cw.pending {
+		return cw.body.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.c.config.MinBytes {
+		cw.start()
+		buf := cw.buf
+		cw.buf = nil
+		if _, err := cw.body.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// plainWriter receives the output of the decoder.
+type plainWriter struct {
+	cw *compressWriter
+}
+
+func (p plainWriter) Write(b []byte) (int, error) {
+	return p.cw.writePlain(b)
+}
+
+// Flush stops holding the body back, as the client is waiting for it. It is a
+// no-op while decoding, which happens on another goroutine.
+func (cw *compressWriter) Flush() {
+	if cw.decoder != nil || cw.status == 0 {
+		return
+	}
+	if cw.pending {
+		cw.start()
+		cw.body.Write(cw.buf)
+		cw.buf = nil
+	}
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.client.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.client
+}
+
+// finish completes the response once the handler returns: bodies that never
+// reached MinBytes go out as they are, with their length now known.
+func (cw *compressWriter) finish() error {
+	if cw.upgraded && cw.status == 0 {
+		return nil
+	}
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	var err error
+	if cw.decoder != nil {
+		cw.decoder.Close()
+		<-cw.decoded
+	}
+	if cw.pending {
+		cw.pending = false
+		cw.client.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		cw.client.WriteHeader(cw.status)
+		_, err = cw.client.Write(cw.buf)
+	}
+	if cw.encoder != nil {
+		if cerr := cw.encoder.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
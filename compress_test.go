@@ -0,0 +1,114 @@
+package holler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// compressedProxy registers a backend at /compressed with config, whose
+// upstream answers with body, already encoded in coding unless it is empty.
+func compressedProxy(t *testing.T, config *CompressionConfig, coding string, body []byte) *HollerProxy {
+	h := newTestProxy(t)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if len(coding) == 0 {
+			w.Write(body)
+			return
+		}
+		encoding, _ := lookupEncoding(coding)
+		w.Header().Set("Content-Encoding", coding)
+		encoder, err := encoding.NewWriter(w, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		encoder.Write(body)
+		encoder.Close()
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/compressed", Compression: config, Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func decode(t *testing.T, coding string, body []byte) []byte {
+	encoding, ok := lookupEncoding(coding)
+	if !ok {
+		t.Fatalf("%s is not registered", coding)
+	}
+	r, err := encoding.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestCompressBuiltInEncodings(t *testing.T) {
+	body := []byte(strings.Repeat("holler compresses this body. ", 200))
+
+	for _, coding := range []string{"br", "zstd", "gzip", "deflate"} {
+		for _, level := range []int{0, 1} {
+			h := compressedProxy(t, &CompressionConfig{Encodings: []string{coding}, Level: level}, "", body)
+			r := httptest.NewRequest("GET", "/compressed", nil)
+			r.Header.Set("Accept-Encoding", coding)
+			rec := serve(h, r)
+
+			if got := rec.Header().Get("Content-Encoding"); got != coding {
+				t.Errorf("%s level %d: got Content-Encoding %q", coding, level, got)
+				continue
+			}
+			if rec.Body.Len() >= len(body) {
+				t.Errorf("%s level %d: %d bytes compressed to %d", coding, level, len(body), rec.Body.Len())
+			}
+			if decoded := decode(t, coding, rec.Body.Bytes()); !bytes.Equal(decoded, body) {
+				t.Errorf("%s level %d: body did not survive a round trip", coding, level)
+			}
+		}
+	}
+}
+
+func TestCompressDefaultPreference(t *testing.T) {
+	body := []byte(strings.Repeat("a", 4096))
+	h := compressedProxy(t, &CompressionConfig{}, "", body)
+
+	for accept, want := range map[string]string{
+		"gzip, deflate, br, zstd": "br",
+		"gzip, zstd":              "zstd",
+		"deflate, gzip":           "gzip",
+		"br;q=0.5, gzip":          "gzip",
+	} {
+		r := httptest.NewRequest("GET", "/compressed", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		if got := serve(h, r).Header().Get("Content-Encoding"); got != want {
+			t.Errorf("%q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestDecompressUpstream(t *testing.T) {
+	body := []byte(strings.Repeat("decoded for the client. ", 100))
+
+	for _, coding := range []string{"br", "zstd"} {
+		h := compressedProxy(t, &CompressionConfig{Encodings: []string{"gzip"}, DecompressUpstream: true}, coding, body)
+		r := httptest.NewRequest("GET", "/compressed", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := serve(h, r)
+
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("%s upstream: got Content-Encoding %q, want gzip", coding, got)
+			continue
+		}
+		if decoded := decode(t, "gzip", rec.Body.Bytes()); !bytes.Equal(decoded, body) {
+			t.Errorf("%s upstream: body did not survive re-encoding", coding)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package holler
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AdaptiveAIMD grows the limit by one per limit's worth of successful
+	// requests and cuts it by AIMDBackoff on errors or slow responses.
+	AdaptiveAIMD = "aimd"
+	// AdaptiveGradient scales the limit by the ratio of the best observed
+	// latency to the current latency, leaving headroom for queueing.
+	AdaptiveGradient = "gradient"
+
+	defaultQueueTimeoutMS  = 1000
+	defaultAIMDBackoff     = 0.9
+	defaultAdaptiveMaximum = 1000
+	gradientSmoothing      = 0.2
+	gradientMinRTTReset    = time.Minute
+)
+
+var (
+	errQueueFull    = errors.New("request queue full")
+	errQueueTimeout = errors.New("timed out waiting in request queue")
+)
+
+// ConcurrencyLimit bounds the requests a backend has in flight, overall and
+// per target. Requests over the limit wait in a FIFO queue of QueueSize for up
+// to QueueTimeoutMS milliseconds (default 1000) and are answered 503 when the
+// queue is full or the wait times out.
+// With Adaptive set to aimd or gradient, MaxInFlight is only the starting
+// limit, which then moves between MinLimit and MaxLimit with observed upstream
+// latency. A response is treated as a failure for aimd when it is a 5xx or
+// slower than LatencyThresholdMS.
+type ConcurrencyLimit struct {
+	MaxInFlight          int     `json:"max_in_flight,omitempty"`
+	MaxInFlightPerTarget int     `json:"max_in_flight_per_target,omitempty"`
+	QueueSize            int     `json:"queue_size,omitempty"`
+	QueueTimeoutMS       int     `json:"queue_timeout_ms,omitempty"`
+	Adaptive             string  `json:"adaptive,omitempty"`
+	MinLimit             int     `json:"min_limit,omitempty"`
+	MaxLimit             int     `json:"max_limit,omitempty"`
+	LatencyThresholdMS   int     `json:"latency_threshold_ms,omitempty"`
+	AIMDBackoff          float64 `json:"aimd_backoff,omitempty"`
+}
+
+// concurrencyLimiter admits requests to a backend, holding the ones it can't
+// admit yet in a FIFO queue.
+type concurrencyLimiter struct {
+	config   *ConcurrencyLimit
+	limit    float64
+	inFlight int
+	waiters  *list.List
+	minRTT   time.Duration
+	rtt      time.Duration
+	rttReset time.Time
+	sync.Mutex
+}
+
+type waiter struct {
+	ready chan struct{}
+}
+
+func newConcurrencyLimiter(c *ConcurrencyLimit) (*concurrencyLimiter, error) {
+	switch c.Adaptive {
+	case "", AdaptiveAIMD, AdaptiveGradient:
+	default:
+		return nil, errors.New("unknown adaptive concurrency mode " + c.Adaptive)
+	}
+	if c.MaxInFlight < 0 || c.MaxInFlightPerTarget < 0 || c.QueueSize < 0 || c.QueueTimeoutMS < 0 {
+		return nil, errors.New("concurrency limits can not be negative")
+	}
+	if c.QueueTimeoutMS == 0 {
+		c.QueueTimeoutMS = defaultQueueTimeoutMS
+	}
+	if len(c.Adaptive) != 0 {
+		if c.MinLimit <= 0 {
+			c.MinLimit = 1
+		}
+		if c.MaxLimit <= 0 {
+			c.MaxLimit = defaultAdaptiveMaximum
+		}
+		if c.MaxInFlight == 0 {
+			c.MaxInFlight = c.MinLimit
+		}
+		if c.AIMDBackoff <= 0 || c.AIMDBackoff >= 1 {
+			c.AIMDBackoff = defaultAIMDBackoff
+		}
+	}
+
+	return &concurrencyLimiter{
+		config:   c,
+		limit:    float64(c.MaxInFlight),
+		waiters:  list.New(),
+		rttReset: time.Now().Add(gradientMinRTTReset),
+	}, nil
+}
+
+// acquire waits until the backend is under its limit and admit accepts the
+// request. admit is called with the limiter held and returns the target the
+// request is pinned to, if any.
+func (c *concurrencyLimiter) acquire(r *http.Request, admit func() (*Target, bool)) (*Target, error) {
+	c.Lock()
+	if c.waiters.Len() == 0 {
+		if t, ok := c.tryAdmit(admit); ok {
+			c.Unlock()
+			return t, nil
+		}
+	}
+	if c.waiters.Len() >= c.config.QueueSize {
+		c.Unlock()
+		return nil, errQueueFull
+	}
+	w := &waiter{ready: make(chan struct{}, 1)}
+	e := c.waiters.PushBack(w)
+	c.Unlock()
+
+	timer := time.NewTimer(time.Duration(c.config.QueueTimeoutMS) * time.Millisecond)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.ready:
+			c.Lock()
+			if t, ok := c.tryAdmit(admit); ok {
+				c.waiters.Remove(e)
+				c.wakeNext()
+				c.Unlock()
+				return t, nil
+			}
+			c.Unlock()
+		case <-timer.C:
+			c.leave(e)
+			return nil, errQueueTimeout
+		case <-r.Context().Done():
+			c.leave(e)
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+func (c *concurrencyLimiter) tryAdmit(admit func() (*Target, bool)) (*Target, bool) {
+	if c.config.MaxInFlight != 0 && float64(c.inFlight) >= math.Floor(c.limit) {
+		return nil, false
+	}
+	t, ok := admit()
+	if !ok {
+		return nil, false
+	}
+	c.inFlight++
+	return t, true
+}
+
+// leave removes a waiter that gave up, passing on any wake up it was sent.
+func (c *concurrencyLimiter) leave(e *list.Element) {
+	c.Lock()
+	defer c.Unlock()
+	c.waiters.Remove(e)
+	c.wakeNext()
+}
+
+// wakeNext signals the waiter at the head of the queue to retry admission.
+func (c *concurrencyLimiter) wakeNext() {
+	if head := c.waiters.Front(); head != nil {
+		select {
+		case head.Value.(*waiter).ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// release returns a request's slot and feeds the latency and outcome of its
+// upstream round trip to the adaptive limit. Requests that never reached a
+// target, with a zero latency, leave the limit alone.
+func (c *concurrencyLimiter) release(latency time.Duration, failed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.inFlight--
+	if latency == 0 {
+		c.wakeNext()
+		return
+	}
+	switch c.config.Adaptive {
+	case AdaptiveAIMD:
+		threshold := time.Duration(c.config.LatencyThresholdMS) * time.Millisecond
+		if failed || (threshold != 0 && latency > threshold) {
+			c.limit *= c.config.AIMDBackoff
+		} else {
+			c.limit += 1 / c.limit
+		}
+	case AdaptiveGradient:
+		c.gradient(latency)
+	}
+	c.limit = math.Max(float64(c.config.MinLimit), c.limit)
+	if c.config.MaxLimit != 0 {
+		c.limit = math.Min(float64(c.config.MaxLimit), c.limit)
+	}
+
+	c.wakeNext()
+}
+
+// gradient moves the limit towards limit * minRTT/rtt plus a queue allowance
+// of sqrt(limit), in the style of Netflix's gradient limiter. The minimum RTT
+// is forgotten periodically so the limit can recover after a target gets
+// permanently slower.
+func (c *concurrencyLimiter) gradient(latency time.Duration) {
+	now := time.Now()
+	if c.minRTT == 0 || latency < c.minRTT || now.After(c.rttReset) {
+		c.minRTT = latency
+		c.rttReset = now.Add(gradientMinRTTReset)
+	}
+	if c.rtt == 0 {
+		c.rtt = latency
+	} else {
+		c.rtt = time.Duration(float64(c.rtt)*(1-gradientSmoothing) + float64(latency)*gradientSmoothing)
+	}
+	if c.rtt <= 0 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, float64(c.minRTT)/float64(c.rtt)))
+	next := c.limit*gradient + math.Sqrt(c.limit)
+	c.limit = c.limit*(1-gradientSmoothing) + next*gradientSmoothing
+}
+
+func (c *concurrencyLimiter) currentLimit() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.limit
+}
+
+// admitTarget selects a healthy target for r with capacity left under the per
+// target limit, or accepts any request when there is no per target limit and
+// leaves choosing the target to the director.
+func (b *Backend) admitTarget(r *http.Request) (*Target, bool) {
+	max := int64(b.Concurrency.MaxInFlightPerTarget)
+	if max == 0 {
+		return nil, true
+	}
+	t, err := b.selectTarget(r, b.clientAddr(r), func(t *Target) bool {
+		return atomic.LoadInt64(&t.inFlight) < max
+	})
+	if err != nil {
+		return nil, false
+	}
+	atomic.AddInt64(&t.inFlight, 1)
+	return t, true
+}
+
+// limitConcurrency wraps the handler of an http backend with its concurrency
+// limit.
+func (h *HollerProxy) limitConcurrency(inner http.Handler, b *Backend) http.Handler {
+	if b.concurrency == nil {
+		return inner
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, err := b.concurrency.acquire(r, func() (*Target, bool) {
+			return b.admitTarget(r)
+		})
+		if err != nil {
+			h.logFor(r).Debugf("backend %s shedding request: %s", b.NamedRoute, err)
+			h.metrics.shed.add(1, b.NamedRoute, shedReason(err))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		if target != nil {
+			proxyStateFrom(r).target = target
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			// the target's slot has to be free before queued requests are woken
+			if target != nil {
+				atomic.AddInt64(&target.inFlight, -1)
+			}
+			b.concurrency.release(proxyStateFrom(r).upstream, rec.status() >= 500)
+			h.metrics.concurrencyLimit.set(b.concurrency.currentLimit(), b.NamedRoute)
+		}()
+
+		inner.ServeHTTP(rec, r)
+	})
+}
+
+func shedReason(err error) string {
+	switch err {
+	case errQueueFull:
+		return "queue_full"
+	case errQueueTimeout:
+		return "queue_timeout"
+	}
+	return "canceled"
+}
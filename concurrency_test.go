@@ -0,0 +1,184 @@
+package holler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type outcome struct {
+	latency time.Duration
+	failed  bool
+}
+
+// repeat returns n releases of requests with the same outcome.
+func repeat(n int, r outcome) []outcome {
+	releases := make([]outcome, n)
+	for i := range releases {
+		releases[i] = r
+	}
+	return releases
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	fast, slow := 10*time.Millisecond, 100*time.Millisecond
+	for _, c := range []struct {
+		name     string
+		config   ConcurrencyLimit
+		releases []outcome
+		min, max float64
+	}{
+		{"aimd success", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10},
+			repeat(1, outcome{fast, false}), 10.1, 10.1},
+		{"aimd a limit of successes", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10},
+			repeat(10, outcome{fast, false}), 10.9, 11},
+		{"aimd failure", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10},
+			repeat(1, outcome{fast, true}), 9, 9},
+		{"aimd over the latency threshold", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10, LatencyThresholdMS: 50},
+			repeat(1, outcome{slow, false}), 9, 9},
+		{"aimd custom backoff", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10, AIMDBackoff: 0.5},
+			repeat(1, outcome{fast, true}), 5, 5},
+		{"aimd floor", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10, MinLimit: 4},
+			repeat(20, outcome{fast, true}), 4, 4},
+		{"aimd ceiling", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10, MaxLimit: 11},
+			repeat(50, outcome{fast, false}), 11, 11},
+		{"no upstream round trip", ConcurrencyLimit{Adaptive: AdaptiveAIMD, MaxInFlight: 10},
+			repeat(5, outcome{0, true}), 10, 10},
+		{"gradient steady latency", ConcurrencyLimit{Adaptive: AdaptiveGradient, MaxInFlight: 10},
+			repeat(10, outcome{fast, false}), 15, 20},
+		{"gradient rising latency", ConcurrencyLimit{Adaptive: AdaptiveGradient, MaxInFlight: 10},
+			append(repeat(1, outcome{fast, false}), repeat(20, outcome{slow, false})...), 4, 7},
+		{"gradient ceiling", ConcurrencyLimit{Adaptive: AdaptiveGradient, MaxInFlight: 10, MaxLimit: 15},
+			repeat(50, outcome{fast, false}), 15, 15},
+	} {
+		l, err := newConcurrencyLimiter(&c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range c.releases {
+			l.inFlight++
+			l.release(r.latency, r.failed)
+		}
+		if got := l.currentLimit(); got < c.min-1e-9 || got > c.max+1e-9 {
+			t.Errorf("%s: got a limit of %.3f, want %.3f to %.3f", c.name, got, c.min, c.max)
+		}
+	}
+}
+
+// concurrencyProxy registers a backend at /bounded with limit whose targets
+// hold each request until it is sent on release. entered receives the URL of
+// the target for every request that reached one.
+func concurrencyProxy(t *testing.T, limit *ConcurrencyLimit, targets int) (h *HollerProxy, entered chan string, release chan struct{}) {
+	h = newTestProxy(t)
+	entered, release = make(chan string, 10), make(chan struct{})
+
+	b := &Backend{NamedRoute: "/bounded", Concurrency: limit}
+	for i := 0; i < targets; i++ {
+		var target *Target
+		target = upstream(t, func(w http.ResponseWriter, r *http.Request) {
+			entered <- target.URL
+			<-release
+		})
+		b.Targets = append(b.Targets, target)
+	}
+	// registered after the targets so it runs before they are closed
+	t.Cleanup(func() { close(release) })
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return h, entered, release
+}
+
+// send serves a request in the background, returning its status code on the
+// channel once answered.
+func send(h *HollerProxy) chan int {
+	code := make(chan int, 1)
+	go func() { code <- serve(h, httptest.NewRequest("GET", "/bounded", nil)).Code }()
+	return code
+}
+
+func TestConcurrencyQueue(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		limit   ConcurrencyLimit
+		freeIn  time.Duration
+		want    int
+		atLeast time.Duration
+	}{
+		{"no queue", ConcurrencyLimit{MaxInFlight: 1}, 0, http.StatusServiceUnavailable, 0},
+		{"queue timeout", ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeoutMS: 50}, 0, http.StatusServiceUnavailable, 50 * time.Millisecond},
+		{"slot freed while queued", ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeoutMS: 5000}, 20 * time.Millisecond, http.StatusOK, 20 * time.Millisecond},
+	} {
+		h, entered, release := concurrencyProxy(t, &c.limit, 1)
+
+		first := send(h)
+		<-entered
+		if c.freeIn != 0 {
+			time.AfterFunc(c.freeIn, func() {
+				release <- struct{}{}
+				<-entered
+				release <- struct{}{}
+			})
+		}
+
+		start := time.Now()
+		code := <-send(h)
+		if elapsed := time.Since(start); code != c.want || elapsed < c.atLeast {
+			t.Errorf("%s: got %d after %s, want %d after at least %s", c.name, code, elapsed, c.want, c.atLeast)
+		}
+		if c.freeIn == 0 {
+			release <- struct{}{}
+		}
+		if code := <-first; code != http.StatusOK {
+			t.Errorf("%s: admitted request got %d", c.name, code)
+		}
+	}
+}
+
+func TestConcurrencyQueueFull(t *testing.T) {
+	h, entered, release := concurrencyProxy(t, &ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeoutMS: 5000}, 1)
+
+	first := send(h)
+	<-entered
+	queued := send(h)
+	time.Sleep(20 * time.Millisecond)
+
+	// the queue holds one request, so a third is shed without waiting
+	start := time.Now()
+	if code := <-send(h); code != http.StatusServiceUnavailable || time.Since(start) > time.Second {
+		t.Errorf("got %d after %s with the queue full, want an immediate 503", code, time.Since(start))
+	}
+
+	release <- struct{}{}
+	<-entered
+	release <- struct{}{}
+	if a, b := <-first, <-queued; a != http.StatusOK || b != http.StatusOK {
+		t.Errorf("got %d and %d for the admitted and queued requests", a, b)
+	}
+}
+
+func TestConcurrencyPerTarget(t *testing.T) {
+	h, entered, release := concurrencyProxy(t, &ConcurrencyLimit{MaxInFlightPerTarget: 1, QueueTimeoutMS: 50}, 2)
+
+	first, second := send(h), send(h)
+	if a, b := <-entered, <-entered; a == b {
+		t.Fatalf("both requests went to %s with a limit of one per target", a)
+	}
+	// both targets are full and there is no queue
+	if code := <-send(h); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d with every target at its limit, want 503", code)
+	}
+
+	release <- struct{}{}
+	release <- struct{}{}
+	<-first
+	<-second
+	// a freed target takes requests again
+	third := send(h)
+	<-entered
+	release <- struct{}{}
+	if code := <-third; code != http.StatusOK {
+		t.Errorf("got %d once the targets were free", code)
+	}
+}
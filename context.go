@@ -0,0 +1,168 @@
+package holler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type contextKey int
+
+// statusClientClosed is recorded, as nginx does, for requests whose client
+// went away before anything was written to it.
+const statusClientClosed = 499
+
+const (
+	proxyStateKey contextKey = iota
+	requestContextKey
+)
+
+// proxyState carries what holler learns about a proxied request as it moves
+// through the backend handler, the director and the transport.
+type proxyState struct {
+	backend  *Backend
+	target   *Target
+	start    time.Time
+	upstream time.Duration
+	span     *Span
+	id       string
+	// set once the response has been written
+	status   int
+	bytesIn  int64
+	bytesOut int64
+	duration time.Duration
+}
+
+func withProxyState(r *http.Request, s *proxyState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyStateKey, s))
+}
+
+// proxyStateFrom returns the state attached by the backend handler, or an
+// empty state if there is none so callers don't need to check.
+func proxyStateFrom(r *http.Request) *proxyState {
+	if s, ok := r.Context().Value(proxyStateKey).(*proxyState); ok {
+		return s
+	}
+	return &proxyState{}
+}
+
+func (s *proxyState) targetURL() string {
+	if s.target == nil {
+		return ""
+	}
+	return s.target.URL
+}
+
+// track wraps the handler of an http backend, attaching a proxyState to each
+// request and reporting the finished request to metrics and the access log.
+func (h *HollerProxy) track(inner http.Handler, b *Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &proxyState{backend: b, start: time.Now(), id: requestID(r)}
+		r = withProxyState(r, state)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+
+		if h.tracer != nil {
+			state.span = h.tracer.startTrace(r, b)
+			state.span.Attributes["holler.request_id"] = state.id
+		}
+
+		// report the request even when the handler panics, as the proxy does
+		// with http.ErrAbortHandler when a response can't be copied
+		h.metrics.inFlight.add(1, b.NamedRoute)
+		served := false
+		defer func() {
+			h.metrics.inFlight.add(-1, b.NamedRoute)
+
+			state.status = rec.status()
+			switch {
+			case rec.code == 0 && r.Context().Err() != nil:
+				state.status = statusClientClosed
+			case !served && rec.code == 0:
+				state.status = http.StatusInternalServerError
+			}
+			state.bytesIn = body.n
+			state.bytesOut = rec.bytes
+			state.duration = time.Since(state.start)
+
+			if state.span != nil {
+				state.span.Attributes["http.status_code"] = strconv.Itoa(state.status)
+				state.span.Attributes["holler.target"] = state.targetURL()
+				if state.status >= 500 {
+					state.span.Error = http.StatusText(state.status)
+				}
+				h.tracer.end(state.span)
+			}
+
+			h.metrics.observeRequest(state)
+			h.accessLog.log(r, state)
+			if b.canary != nil {
+				b.canary.record(state)
+			}
+		}()
+
+		inner.ServeHTTP(rec, r)
+		served = true
+	})
+}
+
+// responseRecorder remembers the status and size of a response on its way to
+// the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 && code >= 200 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses through the recorder.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
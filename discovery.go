@@ -0,0 +1,273 @@
+package holler
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// DiscoveryA resolves targets from A and AAAA records.
+	DiscoveryA = "a"
+	// DiscoverySRV resolves targets from SRV records.
+	DiscoverySRV = "srv"
+
+	defaultDiscoveryMinTTL = 5
+	defaultDiscoveryMaxTTL = 300
+)
+
+// DiscoveryConfig resolves the targets of a backend from DNS. Type a (the
+// default) looks up the A and AAAA records of Name and targets each address
+// on Port. Type srv looks up the SRV records of Name, and their priority and
+// weight become the targets' Priority and Weight. Target URLs use Scheme,
+// which defaults to the backend's kind, and get HealthRoute.
+// Names are resolved again when their records' TTL runs out, kept between
+// MinTTL (default 5) and MaxTTL (default 300) seconds. Resolver is the DNS
+// server's host:port, by default the first nameserver of /etc/resolv.conf.
+// Targets seen before keep their health, new targets start healthy. Failed
+// lookups and lookups without records keep the current targets.
+type DiscoveryConfig struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Port        int    `json:"port,omitempty"`
+	Scheme      string `json:"scheme,omitempty"`
+	HealthRoute string `json:"health_route,omitempty"`
+	Resolver    string `json:"resolver,omitempty"`
+	MinTTL      int    `json:"min_ttl,omitempty"`
+	MaxTTL      int    `json:"max_ttl,omitempty"`
+}
+
+type discovery struct {
+	config   *DiscoveryConfig
+	backend  *Backend
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDiscovery(b *Backend) (*discovery, error) {
+	config := b.Discovery
+	if len(config.Name) == 0 {
+		return nil, errors.New("discovery name is empty")
+	}
+	if _, err := dnsLabels(config.Name); err != nil {
+		return nil, err
+	}
+	if len(b.Groups) != 0 {
+		return nil, errors.New("discovery can not be used with target groups")
+	}
+	switch config.Type {
+	case "":
+		config.Type = DiscoveryA
+		fallthrough
+	case DiscoveryA:
+		if config.Port <= 0 || config.Port > 65535 {
+			return nil, errors.New("discovery of a records requires a port")
+		}
+	case DiscoverySRV:
+	default:
+		return nil, errors.New("unknown discovery type " + config.Type)
+	}
+	if len(config.Scheme) == 0 {
+		config.Scheme = b.Kind
+	}
+	if len(config.Resolver) == 0 {
+		config.Resolver = systemResolver()
+	} else if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+		config.Resolver = net.JoinHostPort(config.Resolver, "53")
+	}
+	if config.MinTTL <= 0 {
+		config.MinTTL = defaultDiscoveryMinTTL
+	}
+	if config.MaxTTL < config.MinTTL {
+		config.MaxTTL = defaultDiscoveryMaxTTL
+		if config.MaxTTL < config.MinTTL {
+			config.MaxTTL = config.MinTTL
+		}
+	}
+
+	return &discovery{
+		config:  config,
+		backend: b,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// refresh resolves the targets and reconciles the backend with them,
+// returning when to refresh next.
+func (d *discovery) refresh() (time.Duration, error) {
+	var (
+		targets []*Target
+		ttl     uint32
+		err     error
+	)
+	if d.config.Type == DiscoverySRV {
+		targets, ttl, err = d.resolveSRV()
+	} else {
+		targets, ttl, err = d.resolveAddrs(d.config.Name, d.config.Port, 0, 0)
+	}
+	if err == nil && len(targets) == 0 {
+		err = errors.New("no records for " + d.config.Name)
+	}
+	if err != nil {
+		return d.clamp(0), err
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].URL < targets[j].URL })
+	if err := d.backend.SetTargets(targets); err != nil {
+		return d.clamp(0), err
+	}
+	return d.clamp(ttl), nil
+}
+
+func (d *discovery) resolveSRV() ([]*Target, uint32, error) {
+	answer, err := dnsQuery(d.config.Resolver, d.config.Name, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		targets []*Target
+		ttl     = minTTL(answer.answers)
+	)
+	for _, r := range answer.answers {
+		// a target of "." means the service is not available there
+		if r.typ != dnsTypeSRV || len(r.target) == 0 {
+			continue
+		}
+
+		var addrs []*Target
+		for _, extra := range answer.additional {
+			if extra.name == r.target && extra.ip != nil {
+				addrs = append(addrs, d.target(extra.ip, int(r.port), int(r.priority), int(r.weight)))
+				ttl = lowerTTL(ttl, extra.ttl)
+			}
+		}
+		if len(addrs) == 0 {
+			var addrTTL uint32
+			if addrs, addrTTL, err = d.resolveAddrs(r.target, int(r.port), int(r.priority), int(r.weight)); err != nil {
+				return nil, 0, err
+			}
+			ttl = lowerTTL(ttl, addrTTL)
+		}
+		targets = append(targets, addrs...)
+	}
+	return targets, ttl, nil
+}
+
+// resolveAddrs looks up the A and AAAA records of name. A failed lookup of
+// one family, such as a resolver refusing AAAA queries, is only an error
+// when the other found no addresses either.
+func (d *discovery) resolveAddrs(name string, port, priority, weight int) ([]*Target, uint32, error) {
+	var (
+		targets []*Target
+		ttl     uint32
+		seen    = map[string]bool{}
+		failed  error
+	)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answer, err := dnsQuery(d.config.Resolver, name, qtype)
+		if err != nil {
+			failed = err
+			continue
+		}
+		ttl = lowerTTL(ttl, minTTL(answer.answers))
+		for _, r := range answer.answers {
+			if r.typ != qtype || seen[r.ip.String()] {
+				continue
+			}
+			seen[r.ip.String()] = true
+			targets = append(targets, d.target(r.ip, port, priority, weight))
+		}
+	}
+	if failed != nil && len(targets) == 0 {
+		return nil, 0, failed
+	}
+	return targets, ttl, nil
+}
+
+func (d *discovery) target(ip net.IP, port, priority, weight int) *Target {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	return &Target{
+		URL:         d.config.Scheme + "://" + addr,
+		Healthy:     true,
+		HealthRoute: d.config.HealthRoute,
+		Priority:    priority,
+		Weight:      weight,
+	}
+}
+
+// clamp turns a TTL in seconds into the time until the next refresh.
+func (d *discovery) clamp(ttl uint32) time.Duration {
+	seconds := int(ttl)
+	if seconds < d.config.MinTTL {
+		seconds = d.config.MinTTL
+	}
+	if seconds > d.config.MaxTTL {
+		seconds = d.config.MaxTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// run refreshes the targets whenever their TTL runs out until stopped.
+func (d *discovery) run(next time.Duration, log *logrus.Entry) {
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-timer.C:
+			wait, err := d.refresh()
+			if err != nil {
+				log.Warnf("discovery of %s for backend %s failed, keeping targets: %s", d.config.Name, d.backend.NamedRoute, err)
+			} else {
+				log.Debugf("discovered targets for backend %s: %s", d.backend.NamedRoute, strings.Join(targetURLs(d.backend.targets()), ", "))
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// startDiscovery keeps resolving the targets of a registered backend, next
+// being the time until the first refresh.
+func (h *HollerProxy) startDiscovery(b *Backend, next time.Duration) {
+	if b.discovery != nil {
+		go b.discovery.run(next, h.Log)
+	}
+}
+
+func (d *discovery) close() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+func targetURLs(targets []*Target) []string {
+	urls := make([]string, 0, len(targets))
+	for _, t := range targets {
+		urls = append(urls, t.URL)
+	}
+	return urls
+}
+
+// minTTL returns the lowest TTL of records, or 0 without records.
+func minTTL(records []dnsRecord) uint32 {
+	var ttl uint32
+	for _, r := range records {
+		ttl = lowerTTL(ttl, r.ttl)
+	}
+	return ttl
+}
+
+// lowerTTL returns the lower of two TTLs, where 0 means unset.
+func lowerTTL(a, b uint32) uint32 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,274 @@
+package holler
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+	dnsTimeout  = 5 * time.Second
+	dnsMaxUDP   = 4096
+)
+
+var errDNSMessage = errors.New("malformed dns message")
+
+// dnsRecord is a resource record of a DNS answer. ip is set for A and AAAA
+// records, priority, weight, port and target for SRV records.
+type dnsRecord struct {
+	name     string
+	typ      uint16
+	ttl      uint32
+	ip       net.IP
+	priority uint16
+	weight   uint16
+	port     uint16
+	target   string
+}
+
+// dnsAnswer holds the answer and additional records of a DNS response.
+type dnsAnswer struct {
+	answers    []dnsRecord
+	additional []dnsRecord
+}
+
+// dnsQuery asks the resolver at addr for the qtype records of name, over udp
+// and again over tcp when the udp response was truncated. Responses other
+// than NOERROR are errors.
+func dnsQuery(addr, name string, qtype uint16) (*dnsAnswer, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := dnsMessage(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsExchange("udp", addr, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) >= 4 && resp[2]&0x02 != 0 {
+		if resp, err = dnsExchange("tcp", addr, query); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != id || resp[2]&0x80 == 0 {
+		return nil, errDNSMessage
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 {
+		return nil, errors.New("dns query for " + name + " failed with rcode " + strconv.Itoa(int(rcode)))
+	}
+	return parseDNSAnswer(resp)
+}
+
+// dnsMessage builds a recursive query for the qtype records of name.
+func dnsMessage(id uint16, name string, qtype uint16) ([]byte, error) {
+	labels, err := dnsLabels(name)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x01 // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range labels {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, nil
+}
+
+// dnsLabels splits name into its labels, which must be 1 to 63 bytes long
+// and add up to a name of at most 255 bytes on the wire.
+func dnsLabels(name string) ([]string, error) {
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) == 0 {
+		return nil, errors.New("dns name " + strconv.Quote(name) + " is empty")
+	}
+	if len(trimmed)+2 > 255 {
+		return nil, errors.New("dns name " + name + " is longer than 255 bytes")
+	}
+	labels := strings.Split(trimmed, ".")
+	for _, label := range labels {
+		if len(label) == 0 {
+			return nil, errors.New("dns name " + name + " has an empty label")
+		}
+		if len(label) > 63 {
+			return nil, errors.New("dns name " + name + " has a label longer than 63 bytes")
+		}
+	}
+	return labels, nil
+}
+
+func dnsExchange(network, addr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, addr, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMaxUDP)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func parseDNSAnswer(msg []byte) (*dnsAnswer, error) {
+	var (
+		questions = int(binary.BigEndian.Uint16(msg[4:]))
+		answers   = int(binary.BigEndian.Uint16(msg[6:]))
+		authority = int(binary.BigEndian.Uint16(msg[8:]))
+		extra     = int(binary.BigEndian.Uint16(msg[10:]))
+		off       = 12
+		err       error
+	)
+	for i := 0; i < questions; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	a := &dnsAnswer{}
+	for i := 0; i < answers+authority+extra; i++ {
+		var r dnsRecord
+		if r, off, err = readDNSRecord(msg, off); err != nil {
+			return nil, err
+		}
+		switch {
+		case i < answers:
+			a.answers = append(a.answers, r)
+		case i >= answers+authority:
+			a.additional = append(a.additional, r)
+		}
+	}
+	return a, nil
+}
+
+func readDNSRecord(msg []byte, off int) (dnsRecord, int, error) {
+	var (
+		r   dnsRecord
+		err error
+	)
+	if r.name, off, err = readDNSName(msg, off); err != nil {
+		return r, 0, err
+	}
+	if off+10 > len(msg) {
+		return r, 0, errDNSMessage
+	}
+	r.typ = binary.BigEndian.Uint16(msg[off:])
+	r.ttl = binary.BigEndian.Uint32(msg[off+4:])
+	size := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+size > len(msg) {
+		return r, 0, errDNSMessage
+	}
+	data := msg[off : off+size]
+
+	switch r.typ {
+	case dnsTypeA, dnsTypeAAAA:
+		if len(data) != net.IPv4len && len(data) != net.IPv6len {
+			return r, 0, errDNSMessage
+		}
+		r.ip = net.IP(append([]byte(nil), data...))
+	case dnsTypeSRV:
+		if len(data) < 7 {
+			return r, 0, errDNSMessage
+		}
+		r.priority = binary.BigEndian.Uint16(data)
+		r.weight = binary.BigEndian.Uint16(data[2:])
+		r.port = binary.BigEndian.Uint16(data[4:])
+		if r.target, _, err = readDNSName(msg, off+6); err != nil {
+			return r, 0, err
+		}
+	}
+	return r, off + size, nil
+}
+
+// readDNSName reads the possibly compressed name at off, returning it
+// lowercased and without the trailing dot, and the offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1
+		jumps  int
+	)
+	for {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		size := int(msg[off])
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case size&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case size&0xc0 != 0 || off+1+size > len(msg):
+			return "", 0, errDNSMessage
+		default:
+			labels = append(labels, string(msg[off+1:off+1+size]))
+			off += 1 + size
+		}
+	}
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf, or the
+// local one.
+func systemResolver() string {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
@@ -0,0 +1,477 @@
+package holler
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRR is a record served by fakeDNS, an A or AAAA record when ip is set
+// and an SRV record otherwise.
+type fakeRR struct {
+	name     string
+	ttl      uint32
+	ip       net.IP
+	priority uint16
+	weight   uint16
+	port     uint16
+	target   string
+}
+
+func (rr fakeRR) typ() uint16 {
+	switch {
+	case rr.ip == nil:
+		return dnsTypeSRV
+	case rr.ip.To4() != nil:
+		return dnsTypeA
+	}
+	return dnsTypeAAAA
+}
+
+// fakeDNS is a DNS server on a udp and a tcp socket of the same port. It
+// answers with the records whose name and type match the question, adding
+// the addresses of SRV targets from extra, and compresses repeated names.
+// With truncate set, udp responses only carry the TC bit, and queries of the
+// refused type are answered with REFUSED.
+type fakeDNS struct {
+	conn     net.PacketConn
+	listener net.Listener
+
+	mu       sync.Mutex
+	records  []fakeRR
+	extra    []fakeRR
+	rcode    byte
+	refused  uint16
+	truncate bool
+	queries  map[string]int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	f := &fakeDNS{queries: map[string]int{}}
+	for i := 0; f.listener == nil; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			conn.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+			continue
+		}
+		f.conn, f.listener = conn, l
+	}
+	t.Cleanup(func() {
+		f.conn.Close()
+		f.listener.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := f.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := f.answer(buf[:n], "udp"); resp != nil {
+				f.conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serveTCP(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeDNS) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeDNS) set(records, extra []fakeRR) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records, f.extra = records, extra
+}
+
+func (f *fakeDNS) count(network string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[network]
+}
+
+func (f *fakeDNS) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+	resp := f.answer(query, "tcp")
+	binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+	conn.Write(append(size[:], resp...))
+}
+
+func (f *fakeDNS) answer(query []byte, network string) []byte {
+	name, off, err := readDNSName(query, 12)
+	if err != nil || off+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries[network]++
+
+	var answers, additional []fakeRR
+	for _, rr := range f.records {
+		if rr.name == name && rr.typ() == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	for _, rr := range answers {
+		for _, extra := range f.extra {
+			if rr.ip == nil && extra.name == rr.target {
+				additional = append(additional, extra)
+			}
+		}
+	}
+
+	m := &dnsWriter{msg: append([]byte(nil), query[:off+4]...), names: map[string]int{name: 12}}
+	m.msg[2] |= 0x80 // response
+	m.msg[3] = f.rcode
+	if qtype == f.refused {
+		m.msg[3] = 5
+	}
+	if f.truncate && network == "udp" {
+		m.msg[2] |= 0x02
+		return m.msg
+	}
+	binary.BigEndian.PutUint16(m.msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(m.msg[10:], uint16(len(additional)))
+	for _, rr := range append(answers, additional...) {
+		m.record(rr)
+	}
+	return m.msg
+}
+
+// dnsWriter appends records to a DNS message, pointing to names written
+// before instead of repeating them.
+type dnsWriter struct {
+	msg   []byte
+	names map[string]int
+}
+
+func (m *dnsWriter) name(name string) {
+	if off, ok := m.names[name]; ok {
+		m.msg = append(m.msg, 0xc0|byte(off>>8), byte(off))
+		return
+	}
+	if len(name) == 0 {
+		m.msg = append(m.msg, 0)
+		return
+	}
+	m.names[name] = len(m.msg)
+	for _, label := range strings.Split(name, ".") {
+		m.msg = append(m.msg, byte(len(label)))
+		m.msg = append(m.msg, label...)
+	}
+	m.msg = append(m.msg, 0)
+}
+
+func (m *dnsWriter) record(rr fakeRR) {
+	m.name(rr.name)
+	var header [10]byte
+	binary.BigEndian.PutUint16(header[:], rr.typ())
+	binary.BigEndian.PutUint16(header[2:], dnsClassIN)
+	binary.BigEndian.PutUint32(header[4:], rr.ttl)
+	m.msg = append(m.msg, header[:]...)
+	start := len(m.msg)
+
+	switch rr.typ() {
+	case dnsTypeA:
+		m.msg = append(m.msg, rr.ip.To4()...)
+	case dnsTypeAAAA:
+		m.msg = append(m.msg, rr.ip.To16()...)
+	default:
+		var srv [6]byte
+		binary.BigEndian.PutUint16(srv[:], rr.priority)
+		binary.BigEndian.PutUint16(srv[2:], rr.weight)
+		binary.BigEndian.PutUint16(srv[4:], rr.port)
+		m.msg = append(m.msg, srv[:]...)
+		m.name(rr.target)
+	}
+	binary.BigEndian.PutUint16(m.msg[start-2:], uint16(len(m.msg)-start))
+}
+
+// discoveryBackend returns an http backend discovering its targets with
+// config from f, without registering it.
+func discoveryBackend(t *testing.T, f *fakeDNS, config *DiscoveryConfig) (*Backend, *discovery) {
+	config.Resolver = f.addr()
+	b := &Backend{NamedRoute: "/discovered", Kind: KindHTTP, Discovery: config}
+	d, err := newDiscovery(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, d
+}
+
+func discovered(b *Backend) string {
+	var targets []string
+	for _, t := range b.targets() {
+		targets = append(targets, t.URL)
+	}
+	return strings.Join(targets, " ")
+}
+
+func TestDiscoveryAddresses(t *testing.T) {
+	f := newFakeDNS(t)
+	f.set([]fakeRR{
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.2")},
+		{name: "api.test", ttl: 30, ip: net.ParseIP("10.0.0.1")},
+		{name: "api.test", ttl: 60, ip: net.ParseIP("fd00::1")},
+		{name: "other.test", ttl: 60, ip: net.ParseIP("10.9.9.9")},
+	}, nil)
+	b, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "API.test.", Port: 8080, HealthRoute: "/health"})
+
+	next, err := d.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := discovered(b), "http://10.0.0.1:8080 http://10.0.0.2:8080 http://[fd00::1]:8080"; got != want {
+		t.Errorf("got targets %q, want %q", got, want)
+	}
+	for _, target := range b.targets() {
+		if !target.healthy() || target.HealthRoute != "/health" {
+			t.Errorf("%s: got healthy %v and health route %q", target.URL, target.healthy(), target.HealthRoute)
+		}
+	}
+	if next != 30*time.Second {
+		t.Errorf("next refresh in %s, want the lowest TTL of 30s", next)
+	}
+	if n := f.count("udp"); n != 2 {
+		t.Errorf("sent %d udp queries, want one for A and one for AAAA", n)
+	}
+}
+
+func TestDiscoverySRV(t *testing.T) {
+	f := newFakeDNS(t)
+	f.set([]fakeRR{
+		{name: "_http._tcp.api.test", ttl: 60, priority: 0, weight: 3, port: 8081, target: "a.api.test"},
+		{name: "_http._tcp.api.test", ttl: 60, priority: 1, weight: 1, port: 8082, target: "b.api.test"},
+		{name: "_http._tcp.api.test", ttl: 60, port: 8083, target: ""},
+		{name: "b.api.test", ttl: 20, ip: net.ParseIP("10.0.1.2")},
+	}, []fakeRR{
+		{name: "a.api.test", ttl: 40, ip: net.ParseIP("10.0.1.1")},
+		{name: "a.api.test", ttl: 40, ip: net.ParseIP("fd00::11")},
+	})
+	b, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "_http._tcp.api.test", Type: DiscoverySRV})
+
+	next, err := d.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]int{
+		"http://10.0.1.1:8081":   {0, 3},
+		"http://[fd00::11]:8081": {0, 3},
+		"http://10.0.1.2:8082":   {1, 1},
+	}
+	if targets := b.targets(); len(targets) != len(want) {
+		t.Errorf("got targets %q, want %d", discovered(b), len(want))
+	}
+	for _, target := range b.targets() {
+		if w, ok := want[target.URL]; !ok || target.Priority != w[0] || target.Weight != w[1] {
+			t.Errorf("%s: got priority %d weight %d, want %v", target.URL, target.Priority, target.Weight, w)
+		}
+	}
+	// the SRV record, the additional addresses and the looked up address
+	// all count towards the TTL
+	if next != 20*time.Second {
+		t.Errorf("next refresh in %s, want 20s", next)
+	}
+}
+
+func TestDiscoveryTruncatedFallsBackToTCP(t *testing.T) {
+	f := newFakeDNS(t)
+	f.mu.Lock()
+	f.truncate = true
+	f.mu.Unlock()
+	f.set([]fakeRR{{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.1")}}, nil)
+	b, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "api.test", Port: 80})
+
+	if _, err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := discovered(b); got != "http://10.0.0.1:80" {
+		t.Errorf("got targets %q", got)
+	}
+	if f.count("udp") != 2 || f.count("tcp") != 2 {
+		t.Errorf("got %d udp and %d tcp queries, want each query retried over tcp", f.count("udp"), f.count("tcp"))
+	}
+}
+
+func TestDiscoveryTTLClamp(t *testing.T) {
+	for _, c := range []struct {
+		ttl  uint32
+		want time.Duration
+	}{
+		{1, 10 * time.Second},
+		{45, 45 * time.Second},
+		{86400, 120 * time.Second},
+	} {
+		f := newFakeDNS(t)
+		f.set([]fakeRR{{name: "api.test", ttl: c.ttl, ip: net.ParseIP("10.0.0.1")}}, nil)
+		_, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "api.test", Port: 80, MinTTL: 10, MaxTTL: 120})
+		if next, err := d.refresh(); err != nil || next != c.want {
+			t.Errorf("ttl %d: got %s and %v, want %s", c.ttl, next, err, c.want)
+		}
+	}
+
+	// failed lookups are retried after the minimum
+	f := newFakeDNS(t)
+	f.mu.Lock()
+	f.rcode = 3
+	f.mu.Unlock()
+	b, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "api.test", Port: 80, MinTTL: 10, MaxTTL: 120})
+	b.Targets = []*Target{{URL: "http://10.0.0.1:80", Healthy: true}}
+	if next, err := d.refresh(); err == nil || next != 10*time.Second {
+		t.Errorf("NXDOMAIN: got %s and %v, want an error and 10s", next, err)
+	}
+	if got := discovered(b); got != "http://10.0.0.1:80" {
+		t.Errorf("failed lookup replaced the targets with %q", got)
+	}
+}
+
+func TestDiscoveryRefusedFamily(t *testing.T) {
+	for _, c := range []struct {
+		records []fakeRR
+		refused uint16
+		want    string
+	}{
+		{[]fakeRR{{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.1")}}, dnsTypeAAAA, "http://10.0.0.1:80"},
+		{[]fakeRR{{name: "api.test", ttl: 60, ip: net.ParseIP("fd00::1")}}, dnsTypeA, "http://[fd00::1]:80"},
+		// without addresses from the other family the failure is an error
+		{nil, dnsTypeAAAA, ""},
+	} {
+		f := newFakeDNS(t)
+		f.set(c.records, nil)
+		f.mu.Lock()
+		f.refused = c.refused
+		f.mu.Unlock()
+		b, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "api.test", Port: 80})
+
+		_, err := d.refresh()
+		if got := discovered(b); got != c.want || (err == nil) != (len(c.want) != 0) {
+			t.Errorf("refused type %d: got targets %q and %v, want %q", c.refused, got, err, c.want)
+		}
+	}
+}
+
+func TestRegisterDuplicateSkipsDiscovery(t *testing.T) {
+	f := newFakeDNS(t)
+	h := newTestProxy(t)
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/discovered", Targets: []*Target{{URL: "http://10.0.0.1:80", Healthy: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	b := &Backend{NamedRoute: "/discovered", Discovery: &DiscoveryConfig{Name: "api.test", Port: 80, Resolver: f.addr()}}
+	if err := h.RegisterBackend(b); err == nil {
+		t.Fatal("registered the same route twice")
+	}
+	if n := f.count("udp"); n != 0 {
+		t.Errorf("duplicate backend sent %d dns queries", n)
+	}
+}
+
+func TestDiscoveryKeepsHealth(t *testing.T) {
+	f := newFakeDNS(t)
+	f.set([]fakeRR{
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.1")},
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.2")},
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.3")},
+	}, nil)
+	b, d := discoveryBackend(t, f, &DiscoveryConfig{Name: "api.test", Port: 80})
+	if _, err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	before := b.targets()
+	before[0].setHealthy(false)
+
+	f.set([]fakeRR{
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.1")},
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.2")},
+		{name: "api.test", ttl: 60, ip: net.ParseIP("10.0.0.4")},
+	}, nil)
+	if _, err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	after := b.targets()
+	if got := discovered(b); got != "http://10.0.0.1:80 http://10.0.0.2:80 http://10.0.0.4:80" {
+		t.Fatalf("got targets %q", got)
+	}
+	if after[0] != before[0] || after[0].healthy() {
+		t.Error("unhealthy target was replaced or became healthy")
+	}
+	if after[1] != before[1] || !after[1].healthy() {
+		t.Error("healthy target was replaced or became unhealthy")
+	}
+	if !after[2].healthy() {
+		t.Error("new target did not start healthy")
+	}
+	if before[2].healthy() {
+		t.Error("removed target is still marked healthy")
+	}
+}
+
+func TestDNSNames(t *testing.T) {
+	msg, err := dnsMessage(7, "api.Example.com.", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _, err := readDNSName(msg, 12); err != nil || name != "api.example.com" {
+		t.Errorf("got %q and %v", name, err)
+	}
+
+	for _, name := range []string{
+		"",
+		".",
+		"api..test",
+		".api.test",
+		strings.Repeat("a", 64) + ".test",
+		strings.Repeat("abcdefghi.", 26) + "test",
+	} {
+		if _, err := dnsMessage(7, name, dnsTypeA); err == nil {
+			t.Errorf("%q: built a query", name)
+		}
+		b := &Backend{NamedRoute: "/discovered", Kind: KindHTTP, Discovery: &DiscoveryConfig{Name: name, Port: 80}}
+		if _, err := newDiscovery(b); err == nil {
+			t.Errorf("%q: discovery accepted the name", name)
+		}
+	}
+	if _, err := dnsMessage(7, strings.Repeat("a", 63)+".test", dnsTypeA); err != nil {
+		t.Errorf("63 byte label rejected: %s", err)
+	}
+}
+
+func TestReadDNSNameLoop(t *testing.T) {
+	// a pointer to itself must not loop forever
+	msg := make([]byte, 14)
+	msg[12], msg[13] = 0xc0, 12
+	if _, _, err := readDNSName(msg, 12); err == nil {
+		t.Error("read a name pointing to itself")
+	}
+}
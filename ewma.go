@@ -0,0 +1,131 @@
+package holler
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEWMADecay   = 10000
+	defaultEWMAPenalty = 1000
+)
+
+// EWMAConfig configures the peak_ewma selector. Latencies observed DecayMS
+// ago (default 10000) weigh about a third as much as fresh ones, and targets
+// idle for long fade back towards being chosen. Failed upstream requests
+// count as taking at least PenaltyMS (default 1000), which is also what busy
+// targets that never answered yet are assumed to take.
+type EWMAConfig struct {
+	DecayMS   int `json:"decay_ms,omitempty"`
+	PenaltyMS int `json:"penalty_ms,omitempty"`
+}
+
+func (c *EWMAConfig) validate() error {
+	if c.DecayMS < 0 || c.PenaltyMS < 0 {
+		return errors.New("ewma decay_ms and penalty_ms can not be negative")
+	}
+	if c.DecayMS == 0 {
+		c.DecayMS = defaultEWMADecay
+	}
+	if c.PenaltyMS == 0 {
+		c.PenaltyMS = defaultEWMAPenalty
+	}
+	return nil
+}
+
+func (c *EWMAConfig) decay() time.Duration {
+	return time.Duration(c.DecayMS) * time.Millisecond
+}
+
+func (c *EWMAConfig) penalty() time.Duration {
+	return time.Duration(c.PenaltyMS) * time.Millisecond
+}
+
+// latencyEWMA is a peak sensitive moving average of a target's latency: it
+// jumps to slower observations at once and decays towards faster ones.
+type latencyEWMA struct {
+	value float64
+	stamp time.Time
+	sync.Mutex
+}
+
+func (e *latencyEWMA) observe(rtt, decay time.Duration, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+
+	x := float64(rtt)
+	if e.stamp.IsZero() || x > e.value {
+		e.value = x
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(decay))
+		e.value = e.value*w + x*(1-w)
+	}
+	e.stamp = now
+}
+
+// get returns the average decayed for the time since the last observation.
+func (e *latencyEWMA) get(decay time.Duration, now time.Time) float64 {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.stamp.IsZero() {
+		return 0
+	}
+	return e.value * math.Exp(-float64(now.Sub(e.stamp))/float64(decay))
+}
+
+// observeLatency feeds the time an upstream attempt took to the target's
+// latency average, when the backend selects by it.
+func (b *Backend) observeLatency(t *Target, rtt time.Duration, failed bool) {
+	if b.TargetSelector != SelectorPeakEWMA {
+		return
+	}
+	if failed && rtt < b.EWMA.penalty() {
+		rtt = b.EWMA.penalty()
+	}
+	t.latency.observe(rtt, b.EWMA.decay(), time.Now())
+}
+
+// peakEWMASelector compares two random candidates by their expected latency,
+// their latency average scaled by their active requests, and picks the
+// lower. Comparing two instead of all keeps a single fast target from being
+// flooded before its average catches up.
+type peakEWMASelector struct {
+	config *EWMAConfig
+}
+
+func (p *peakEWMASelector) pick(s *selection) *Target {
+	n := len(s.candidates)
+	if n == 1 {
+		return s.candidates[0]
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := s.candidates[i], s.candidates[j]
+
+	now := time.Now()
+	if p.cost(b, now) < p.cost(a, now) {
+		return b
+	}
+	return a
+}
+
+func (p *peakEWMASelector) cost(t *Target, now time.Time) float64 {
+	active := float64(atomic.LoadInt64(&t.active))
+	latency := t.latency.get(p.config.decay(), now)
+	if latency == 0 {
+		if active == 0 {
+			return 0
+		}
+		return float64(p.config.penalty()) + active
+	}
+	return latency * (active + 1)
+}
@@ -0,0 +1,88 @@
+package holler
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLatencyEWMA(t *testing.T) {
+	decay := 10 * time.Second
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	e := &latencyEWMA{}
+
+	for _, step := range []struct {
+		name    string
+		observe time.Duration
+		at      time.Duration
+		get     time.Duration
+		want    float64
+	}{
+		{"nothing observed", 0, 0, 0, 0},
+		{"first observation", 100 * time.Millisecond, 0, 0, float64(100 * time.Millisecond)},
+		{"slower jumps at once", 200 * time.Millisecond, time.Second, time.Second, float64(200 * time.Millisecond)},
+		// one decay later the old value keeps a weight of 1/e
+		{"faster decays towards it", 100 * time.Millisecond, 11 * time.Second, 11 * time.Second,
+			float64(200*time.Millisecond)/math.E + float64(100*time.Millisecond)*(1-1/math.E)},
+		{"idle fades", 0, 0, 21 * time.Second,
+			(float64(200*time.Millisecond)/math.E + float64(100*time.Millisecond)*(1-1/math.E)) / math.E},
+	} {
+		if step.observe != 0 {
+			e.observe(step.observe, decay, at(step.at))
+		}
+		if got := e.get(decay, at(step.get)); math.Abs(got-step.want) > 1 {
+			t.Errorf("%s: got %s, want %s", step.name, time.Duration(got), time.Duration(step.want))
+		}
+	}
+}
+
+func TestPeakEWMACost(t *testing.T) {
+	p := &peakEWMASelector{config: &EWMAConfig{}}
+	if err := p.config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for _, c := range []struct {
+		name    string
+		latency time.Duration
+		active  int64
+		want    float64
+	}{
+		{"new and idle", 0, 0, 0},
+		{"new and busy", 0, 2, float64(time.Second) + 2},
+		{"idle", 100 * time.Millisecond, 0, float64(100 * time.Millisecond)},
+		{"busy", 100 * time.Millisecond, 3, float64(400 * time.Millisecond)},
+	} {
+		target := &Target{URL: c.name, active: c.active}
+		if c.latency != 0 {
+			target.latency.observe(c.latency, p.config.decay(), now)
+		}
+		if got := p.cost(target, now); math.Abs(got-c.want) > 1 {
+			t.Errorf("%s: got a cost of %.0f, want %.0f", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPeakEWMAPicksCheaper(t *testing.T) {
+	b := &Backend{NamedRoute: "/ewma", TargetSelector: SelectorPeakEWMA, EWMA: &EWMAConfig{}}
+	if err := b.EWMA.validate(); err != nil {
+		t.Fatal(err)
+	}
+	fast, slow := &Target{URL: "fast", Healthy: true}, &Target{URL: "slow", Healthy: true}
+	b.observeLatency(fast, 10*time.Millisecond, false)
+	// a failure counts as taking at least the penalty
+	b.observeLatency(slow, 10*time.Millisecond, true)
+	if got := slow.latency.get(b.EWMA.decay(), time.Now()); got < float64(900*time.Millisecond) {
+		t.Fatalf("failed request recorded as %s", time.Duration(got))
+	}
+
+	p := &peakEWMASelector{config: b.EWMA}
+	targets := []*Target{slow, fast}
+	for i := 0; i < 20; i++ {
+		if got := p.pick(&selection{targets: targets, candidates: targets}); got != fast {
+			t.Fatalf("picked %s over fast", got.URL)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package holler
+
+import (
+	"errors"
+	"sort"
+)
+
+const defaultFailoverHealthyPercent = 70
+
+// FailoverConfig controls how traffic moves between target priority tiers.
+// Requests go to the healthy targets of the lowest Priority tier, and spill
+// over to the next tier while less than HealthyPercent (default 70) of a tier
+// is healthy. When less than PanicPercent of all targets are healthy the
+// backend panics and routes to every target regardless of health, rather
+// than overloading the few healthy ones; PanicPercent 0 disables it.
+type FailoverConfig struct {
+	HealthyPercent int `json:"healthy_percent,omitempty"`
+	PanicPercent   int `json:"panic_percent,omitempty"`
+}
+
+func (c *FailoverConfig) validate() error {
+	if c.HealthyPercent < 0 || c.HealthyPercent > 100 || c.PanicPercent < 0 || c.PanicPercent > 100 {
+		return errors.New("failover percentages must be between 0 and 100")
+	}
+	if c.HealthyPercent == 0 {
+		c.HealthyPercent = defaultFailoverHealthyPercent
+	}
+	return nil
+}
+
+// candidates returns the targets a request may go to, those eligible in the
+// tiers traffic currently reaches.
+func (b *Backend) candidates(targets []*Target, eligible func(*Target) bool) []*Target {
+	config := b.Failover
+	if config == nil {
+		config = &FailoverConfig{HealthyPercent: defaultFailoverHealthyPercent}
+	}
+
+	healthy := 0
+	for _, t := range targets {
+		if t.healthy() {
+			healthy++
+		}
+	}
+
+	var candidates []*Target
+	if config.PanicPercent > 0 && len(targets) > 0 && 100*healthy < config.PanicPercent*len(targets) {
+		for _, t := range targets {
+			if eligible == nil || eligible(t) {
+				candidates = append(candidates, t)
+			}
+		}
+		return candidates
+	}
+
+	for _, tier := range priorityTiers(targets) {
+		healthy := 0
+		for _, t := range tier {
+			if !t.healthy() {
+				continue
+			}
+			healthy++
+			if eligible == nil || eligible(t) {
+				candidates = append(candidates, t)
+			}
+		}
+		if len(candidates) != 0 && 100*healthy >= config.HealthyPercent*len(tier) {
+			break
+		}
+	}
+	return candidates
+}
+
+// priorityTiers splits targets by Priority, lowest first, keeping their
+// order within a tier.
+func priorityTiers(targets []*Target) [][]*Target {
+	sorted := append([]*Target(nil), targets...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	var tiers [][]*Target
+	for i, t := range sorted {
+		if i == 0 || t.Priority != sorted[i-1].Priority {
+			tiers = append(tiers, nil)
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], t)
+	}
+	return tiers
+}
@@ -0,0 +1,83 @@
+package holler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tieredTargets returns targets a0, a1 and a2 at priority 0, b0 and b1 at 1
+// and c0 at 2, healthy unless named in down.
+func tieredTargets(down ...string) []*Target {
+	var targets []*Target
+	for _, name := range []string{"b0", "a0", "c0", "a1", "b1", "a2"} {
+		healthy := true
+		for _, d := range down {
+			healthy = healthy && d != name
+		}
+		targets = append(targets, &Target{URL: name, Priority: int(name[0] - 'a'), Healthy: healthy})
+	}
+	return targets
+}
+
+func urls(targets []*Target) string {
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.URL)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestPriorityTiers(t *testing.T) {
+	var got []string
+	for _, tier := range priorityTiers(tieredTargets()) {
+		got = append(got, urls(tier))
+	}
+	if want := []string{"a0 a1 a2", "b0 b1", "c0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tiers %q, want %q", got, want)
+	}
+}
+
+func TestFailoverCandidates(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		failover *FailoverConfig
+		down     []string
+		eligible func(*Target) bool
+		want     string
+	}{
+		{"all healthy", nil, nil, nil, "a0 a1 a2"},
+		{"first tier at the threshold", &FailoverConfig{HealthyPercent: 60}, []string{"a1"}, nil, "a0 a2"},
+		{"first tier degraded", nil, []string{"a1"}, nil, "a0 a2 b0 b1"},
+		{"first tier down", nil, []string{"a0", "a1", "a2"}, nil, "b0 b1"},
+		{"two tiers degraded", nil, []string{"a0", "a1", "b1"}, nil, "a2 b0 c0"},
+		{"every target down", nil, []string{"a0", "a1", "a2", "b0", "b1", "c0"}, nil, ""},
+		{"first tier ineligible", nil, nil, func(t *Target) bool { return t.Priority > 0 }, "b0 b1"},
+		{"panic", &FailoverConfig{HealthyPercent: 70, PanicPercent: 50}, []string{"a0", "a1", "a2", "b0"}, nil, "b0 a0 c0 a1 b1 a2"},
+		{"panic skips ineligible", &FailoverConfig{HealthyPercent: 70, PanicPercent: 50}, []string{"a0", "a1", "a2", "b0"},
+			func(t *Target) bool { return t.URL != "c0" }, "b0 a0 a1 b1 a2"},
+		{"above panic", &FailoverConfig{HealthyPercent: 70, PanicPercent: 50}, []string{"a0", "a1", "a2"}, nil, "b0 b1"},
+	} {
+		b := &Backend{NamedRoute: "/tiers", Failover: c.failover}
+		if c.failover != nil {
+			if err := c.failover.validate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := urls(b.candidates(tieredTargets(c.down...), c.eligible)); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFailoverValidate(t *testing.T) {
+	for _, c := range []FailoverConfig{{HealthyPercent: -1}, {HealthyPercent: 101}, {PanicPercent: 101}} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v: validated", c)
+		}
+	}
+	c := &FailoverConfig{}
+	if err := c.validate(); err != nil || c.HealthyPercent != defaultFailoverHealthyPercent {
+		t.Errorf("got %v and healthy_percent %d, want the default", err, c.HealthyPercent)
+	}
+}
@@ -0,0 +1,137 @@
+package holler
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FaultRule injects faults into Percent of a backend's requests, or only of
+// those carrying Header (with Value, when set) so just test traffic is
+// affected. A rule delays requests by DelayMS plus up to JitterMS random
+// milliseconds, then either answers them with AbortStatus instead of
+// proxying them or, with Reset, resets the client connection. Rules are
+// applied in order.
+type FaultRule struct {
+	Header      string  `json:"header,omitempty"`
+	Value       string  `json:"value,omitempty"`
+	Percent     float64 `json:"percent"`
+	DelayMS     int     `json:"delay_ms,omitempty"`
+	JitterMS    int     `json:"jitter_ms,omitempty"`
+	AbortStatus int     `json:"abort_status,omitempty"`
+	Reset       bool    `json:"reset,omitempty"`
+}
+
+func (f *FaultRule) validate() error {
+	if f.Percent <= 0 || f.Percent > 100 {
+		return errors.New("fault percent must be above 0 and at most 100")
+	}
+	if f.DelayMS < 0 || f.JitterMS < 0 {
+		return errors.New("fault delay can not be negative")
+	}
+	if f.AbortStatus != 0 && (f.AbortStatus < 200 || f.AbortStatus > 599) {
+		return errors.New("fault abort_status " + strconv.Itoa(f.AbortStatus) + " is not a valid status")
+	}
+	if f.AbortStatus != 0 && f.Reset {
+		return errors.New("fault can either abort or reset")
+	}
+	if f.DelayMS == 0 && f.JitterMS == 0 && f.AbortStatus == 0 && !f.Reset {
+		return errors.New("fault injects nothing")
+	}
+	return nil
+}
+
+// applies reports whether the rule matches r and r is sampled.
+func (f *FaultRule) applies(r *http.Request) bool {
+	if len(f.Header) != 0 {
+		values, ok := r.Header[http.CanonicalHeaderKey(f.Header)]
+		if !ok {
+			return false
+		}
+		if len(f.Value) != 0 && (len(values) == 0 || values[0] != f.Value) {
+			return false
+		}
+	}
+	return rand.Float64()*100 < f.Percent
+}
+
+func (f *FaultRule) delay() time.Duration {
+	d := time.Duration(f.DelayMS) * time.Millisecond
+	if f.JitterMS > 0 {
+		d += time.Duration(rand.Intn(f.JitterMS+1)) * time.Millisecond
+	}
+	return d
+}
+
+// SetFaults replaces the fault injection rules of a backend.
+func (b *Backend) SetFaults(faults []*FaultRule) error {
+	for _, f := range faults {
+		if err := f.validate(); err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+	}
+
+	b.mu.Lock()
+	b.Faults = faults
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Backend) faults() []*FaultRule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Faults
+}
+
+// injectFaults wraps the handler of an http backend with its fault injection
+// rules.
+func (h *HollerProxy) injectFaults(inner http.Handler, b *Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, f := range b.faults() {
+			if !f.applies(r) {
+				continue
+			}
+
+			if d := f.delay(); d > 0 {
+				h.metrics.faults.add(1, b.NamedRoute, "delay")
+				timer := time.NewTimer(d)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+
+			switch {
+			case f.AbortStatus != 0:
+				h.metrics.faults.add(1, b.NamedRoute, "abort")
+				http.Error(w, http.StatusText(f.AbortStatus), f.AbortStatus)
+				return
+			case f.Reset:
+				h.metrics.faults.add(1, b.NamedRoute, "reset")
+				resetConnection(w)
+				return
+			}
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// resetConnection drops the client connection, with a TCP reset where
+// possible. Connections that can't be hijacked, like HTTP/2 streams, are
+// aborted instead.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,120 @@
+package holler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFaultApplies(t *testing.T) {
+	for _, c := range []struct {
+		rule   FaultRule
+		header http.Header
+		want   bool
+	}{
+		{FaultRule{}, nil, true},
+		{FaultRule{Header: "X-Fault"}, nil, false},
+		{FaultRule{Header: "X-Fault"}, http.Header{"X-Fault": {""}}, true},
+		{FaultRule{Header: "x-fault"}, http.Header{"X-Fault": {"yes"}}, true},
+		{FaultRule{Header: "X-Fault", Value: "yes"}, http.Header{"X-Fault": {"yes"}}, true},
+		{FaultRule{Header: "X-Fault", Value: "yes"}, http.Header{"X-Fault": {"no"}}, false},
+		{FaultRule{Header: "X-Fault", Value: "yes"}, http.Header{"X-Other": {"yes"}}, false},
+	} {
+		c.rule.Percent = 100
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = c.header
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := c.rule.applies(r); got != c.want {
+			t.Errorf("%+v with %v: got %t, want %t", c.rule, c.header, got, c.want)
+		}
+	}
+}
+
+func TestFaultValidate(t *testing.T) {
+	for _, f := range []FaultRule{
+		{Percent: 0, AbortStatus: 503},
+		{Percent: 101, AbortStatus: 503},
+		{Percent: 100, DelayMS: -1},
+		{Percent: 100, AbortStatus: 99},
+		{Percent: 100, AbortStatus: 503, Reset: true},
+		{Percent: 100},
+	} {
+		if err := f.validate(); err == nil {
+			t.Errorf("%+v: validated", f)
+		}
+	}
+}
+
+// faultyProxy registers a backend at /faulty with faults, counting the
+// requests that reach its target in hits.
+func faultyProxy(t *testing.T, faults ...*FaultRule) (*HollerProxy, *int32) {
+	h := newTestProxy(t)
+	hits := new(int32)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/faulty", Faults: faults, Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h, hits
+}
+
+func TestFaultAbort(t *testing.T) {
+	h, hits := faultyProxy(t, &FaultRule{Header: "X-Fault", Percent: 100, AbortStatus: http.StatusServiceUnavailable})
+
+	r := httptest.NewRequest("GET", "/faulty", nil)
+	if rec := serve(h, r); rec.Code != http.StatusOK || atomic.LoadInt32(hits) != 1 {
+		t.Errorf("request without the header got %d", rec.Code)
+	}
+	r.Header.Set("X-Fault", "1")
+	if rec := serve(h, r); rec.Code != http.StatusServiceUnavailable || atomic.LoadInt32(hits) != 1 {
+		t.Errorf("faulted request got %d with %d upstream requests", rec.Code, atomic.LoadInt32(hits))
+	}
+}
+
+func TestFaultDelay(t *testing.T) {
+	h, hits := faultyProxy(t, &FaultRule{Percent: 100, DelayMS: 50})
+	start := time.Now()
+	if rec := serve(h, httptest.NewRequest("GET", "/faulty", nil)); rec.Code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("got %d after %s, want 200 after 50ms", rec.Code, time.Since(start))
+	}
+
+	// a client that goes away ends the delay, and the request goes no further
+	h, hits = faultyProxy(t, &FaultRule{Percent: 100, DelayMS: 5000})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	serve(h, httptest.NewRequest("GET", "/faulty", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second || atomic.LoadInt32(hits) != 0 {
+		t.Errorf("cancelled delay returned after %s with %d upstream requests", elapsed, atomic.LoadInt32(hits))
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	h, hits := faultyProxy(t, &FaultRule{Percent: 100, Reset: true})
+	s := httptest.NewServer(h.Server.Handler)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/faulty")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("got %s from a reset connection", resp.Status)
+	}
+	if n := atomic.LoadInt32(hits); n != 0 {
+		t.Errorf("reset request reached the target %d times", n)
+	}
+}
+
+func TestResetConnectionWithoutHijack(t *testing.T) {
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", r)
+		}
+	}()
+	resetConnection(httptest.NewRecorder())
+}
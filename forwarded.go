@@ -0,0 +1,206 @@
+package holler
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// forwardingHeaders are only passed upstream from trusted proxies.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// parseTrustedProxies parses TrustedProxies, which may hold CIDRs or single
+// addresses.
+func (b *Backend) parseTrustedProxies() error {
+	b.trustedNets = nil
+	for _, cidr := range b.TrustedProxies {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return errors.New("invalid trusted proxy " + cidr)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			cidr += "/" + strconv.Itoa(bits)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		b.trustedNets = append(b.trustedNets, ipNet)
+	}
+	return nil
+}
+
+// trusts reports whether the peer at addr is one of the backend's trusted
+// proxies.
+func (b *Backend) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range b.trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client r is from. Requests from
+// trusted proxies are from the nearest address in X-Forwarded-For, or else
+// Forwarded or X-Real-Ip, that isn't a trusted proxy itself. Any other
+// request is from its peer.
+func (b *Backend) clientAddr(r *http.Request) string {
+	client := clientIP(r)
+	if !b.trusts(client) {
+		return client
+	}
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		client = hops[i]
+		if !b.trusts(client) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedHops returns the client addresses a request was forwarded for,
+// nearest last, from the first of X-Forwarded-For, Forwarded and X-Real-Ip
+// it has.
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	for _, line := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) != 0 {
+		return hops
+	}
+
+	for _, line := range header["Forwarded"] {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hops = append(hops, forwardedIP(strings.Trim(pair[4:], `"`)))
+				}
+			}
+		}
+	}
+	if len(hops) != 0 {
+		return hops
+	}
+
+	if ip := header.Get("X-Real-Ip"); len(ip) != 0 {
+		return []string{strings.TrimSpace(ip)}
+	}
+	return nil
+}
+
+// forwardedIP strips the port and IPv6 brackets from a Forwarded node.
+func forwardedIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// forwardHeaders sets the Host and forwarding headers of an upstream request
+// to target. Forwarding headers from untrusted peers are stripped, and
+// X-Forwarded-For is left to httputil.ReverseProxy to append to.
+func (b *Backend) forwardHeaders(req *http.Request, target *url.URL) {
+	client := clientIP(req)
+	trusted := b.trusts(client)
+	if !trusted {
+		for _, header := range forwardingHeaders {
+			req.Header.Del(header)
+		}
+	}
+
+	host := req.Host
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if b.XForwarded {
+		setIfMissing(req.Header, "X-Forwarded-Proto", proto)
+		setIfMissing(req.Header, "X-Forwarded-Host", host)
+		if _, port, err := net.SplitHostPort(host); err == nil {
+			setIfMissing(req.Header, "X-Forwarded-Port", port)
+		} else if proto == "https" {
+			setIfMissing(req.Header, "X-Forwarded-Port", "443")
+		} else {
+			setIfMissing(req.Header, "X-Forwarded-Port", "80")
+		}
+	}
+
+	if b.Forwarded {
+		element := "for=" + forwardedNode(client) + ";host=" + quoteForwarded(host) + ";proto=" + proto
+		if prior := req.Header.Get("Forwarded"); len(prior) != 0 {
+			element = prior + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	}
+
+	if len(b.Via) != 0 {
+		via := viaProtocol(req.ProtoMajor, req.ProtoMinor) + " " + b.Via
+		if prior := req.Header.Get("Via"); len(prior) != 0 {
+			via = prior + ", " + via
+		}
+		req.Header.Set("Via", via)
+	}
+
+	if b.RewriteHost {
+		req.Host = target.Host
+	}
+}
+
+func setIfMissing(header http.Header, key, value string) {
+	if len(header.Get(key)) == 0 {
+		header.Set(key, value)
+	}
+}
+
+// forwardedNode formats a node for the RFC 7239 for= parameter, quoting and
+// bracketing IPv6 addresses.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// viaProtocol formats the received-protocol of a Via entry, which leaves out
+// the protocol name for HTTP.
+func viaProtocol(major, minor int) string {
+	if major == 1 {
+		return "1." + strconv.Itoa(minor)
+	}
+	return strconv.Itoa(major)
+}
@@ -0,0 +1,147 @@
+package holler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	b := &Backend{NamedRoute: "/", TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}}
+	if err := b.parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		peer   string
+		header map[string]string
+		want   string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "203.0.113.1"},
+		// the client can prepend anything, only the hops added by trusted
+		// proxies count
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.1, 10.0.0.2"}, "203.0.113.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=203.0.113.1;proto=https, for="[2001:db8::2]:4711"`}, "2001:db8::2"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden"}, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-Ip": "203.0.113.1"}, "203.0.113.1"},
+		{"[2001:db8::1]:1234", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "203.0.113.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := b.clientAddr(r); got != c.want {
+			t.Errorf("%s with %v: got %s, want %s", c.peer, c.header, got, c.want)
+		}
+	}
+}
+
+// forwardingProxy registers b at /fwd with a target answering with the Host
+// and headers it got.
+func forwardingProxy(t *testing.T, b *Backend) (*HollerProxy, *Target) {
+	h := newTestProxy(t)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Host", r.Host)
+		json.NewEncoder(w).Encode(r.Header)
+	})
+	b.NamedRoute, b.Targets = "/fwd", []*Target{target}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return h, target
+}
+
+func forwardedRequest(h *HollerProxy, peer string) http.Header {
+	r := httptest.NewRequest("GET", "http://example.com:8080/fwd", nil)
+	r.RemoteAddr = peer
+	r.Header.Set("X-Forwarded-For", "203.0.113.1")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "public.example.com")
+	r.Header.Set("X-Real-Ip", "203.0.113.1")
+	r.Header.Set("Forwarded", "for=203.0.113.1;proto=https")
+	r.Header.Set("Via", "1.1 edge")
+
+	var got http.Header
+	json.Unmarshal(serve(h, r).Body.Bytes(), &got)
+	return got
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	h, target := forwardingProxy(t, &Backend{TrustedProxies: []string{"10.0.0.0/8"}, XForwarded: true, Forwarded: true, Via: "holler", RewriteHost: true})
+	targetHost := strings.TrimPrefix(target.URL, "http://")
+
+	for _, c := range []struct {
+		peer string
+		want map[string]string
+	}{
+		// headers from a trusted proxy are kept and added to
+		{"10.0.0.1:1234", map[string]string{
+			"Host":              targetHost,
+			"X-Forwarded-For":   "203.0.113.1, 10.0.0.1",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "public.example.com",
+			"X-Forwarded-Port":  "8080",
+			"X-Real-Ip":         "203.0.113.1",
+			"Forwarded":         "for=203.0.113.1;proto=https, for=10.0.0.1;host=\"example.com:8080\";proto=http",
+			"Via":               "1.1 edge, 1.1 holler",
+		}},
+		// anyone else's are replaced by what holler saw
+		{"192.0.2.1:1234", map[string]string{
+			"Host":              targetHost,
+			"X-Forwarded-For":   "192.0.2.1",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "example.com:8080",
+			"X-Forwarded-Port":  "8080",
+			"X-Real-Ip":         "",
+			"Forwarded":         "for=192.0.2.1;host=\"example.com:8080\";proto=http",
+			"Via":               "1.1 edge, 1.1 holler",
+		}},
+		{"[2001:db8::1]:1234", map[string]string{
+			"X-Forwarded-For": "2001:db8::1",
+			"Forwarded":       "for=\"[2001:db8::1]\";host=\"example.com:8080\";proto=http",
+		}},
+	} {
+		got := forwardedRequest(h, c.peer)
+		for name, want := range c.want {
+			if value := strings.Join(got[name], ", "); value != want {
+				t.Errorf("%s: upstream got %s %q, want %q", c.peer, name, value, want)
+			}
+		}
+	}
+}
+
+func TestForwardingHeadersOff(t *testing.T) {
+	h, _ := forwardingProxy(t, &Backend{})
+	got := forwardedRequest(h, "10.0.0.1:1234")
+	// without trusted proxies every peer's forwarding headers are dropped, and
+	// only X-Forwarded-For and the client's Host are sent
+	for name, want := range map[string]string{
+		"Host":              "example.com:8080",
+		"X-Forwarded-For":   "10.0.0.1",
+		"X-Forwarded-Proto": "",
+		"X-Forwarded-Port":  "",
+		"Forwarded":         "",
+		"Via":               "1.1 edge",
+	} {
+		if value := strings.Join(got[name], ", "); value != want {
+			t.Errorf("upstream got %s %q, want %q", name, value, want)
+		}
+	}
+}
+
+func TestTrustedProxiesValidated(t *testing.T) {
+	for _, proxies := range [][]string{{"10.0.0.0/33"}, {"proxy.example.com"}} {
+		b := &Backend{TrustedProxies: proxies}
+		if err := b.parseTrustedProxies(); err == nil {
+			t.Errorf("%v accepted", proxies)
+		}
+	}
+}
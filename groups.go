@@ -0,0 +1,235 @@
+package holler
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+)
+
+// TargetGroup is a named set of targets receiving Weight parts of a
+// backend's traffic, such as a stable and a canary release. Weights are
+// relative, so 95 and 5 split traffic 95% to 5%.
+type TargetGroup struct {
+	Name    string    `json:"name"`
+	Weight  int       `json:"weight"`
+	Targets []*Target `json:"targets"`
+
+	selector targetSelector
+}
+
+// GroupOverride forces requests into the target group named by the value of
+// Header or Cookie, as long as that group has a healthy target.
+type GroupOverride struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+}
+
+// configureGroups validates the target groups of a backend and gives each its
+// own target selector.
+func (b *Backend) configureGroups() error {
+	if len(b.Groups) == 0 {
+		if b.GroupOverride != nil {
+			return errors.New("backend " + b.NamedRoute + ": group_override requires groups")
+		}
+		return nil
+	}
+	if len(b.Targets) != 0 {
+		return errors.New("backend " + b.NamedRoute + ": targets and groups are exclusive")
+	}
+	if b.GroupOverride != nil && !b.isHTTP() {
+		return errors.New("backend " + b.NamedRoute + ": group_override requires an http backend")
+	}
+
+	var (
+		names = map[string]bool{}
+		total int
+	)
+	for _, g := range b.Groups {
+		if len(g.Name) == 0 {
+			return errors.New("backend " + b.NamedRoute + ": target group without a name")
+		}
+		if names[g.Name] {
+			return errors.New("backend " + b.NamedRoute + ": duplicate target group " + g.Name)
+		}
+		names[g.Name] = true
+		if g.Weight < 0 {
+			return errors.New("backend " + b.NamedRoute + ": target group " + g.Name + " has a negative weight")
+		}
+		total += g.Weight
+
+		selector, err := newTargetSelector(b)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+		g.selector = selector
+	}
+	if total == 0 {
+		return errors.New("backend " + b.NamedRoute + ": target group weights add up to 0")
+	}
+	return nil
+}
+
+// SetGroupWeights changes the weights of the named target groups. Groups not
+// in weights keep theirs.
+func (b *Backend) SetGroupWeights(weights map[string]int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	for _, g := range b.Groups {
+		weight, ok := weights[g.Name]
+		if !ok {
+			weight = g.Weight
+		}
+		if weight < 0 {
+			return errors.New("backend " + b.NamedRoute + ": target group " + g.Name + " has a negative weight")
+		}
+		total += weight
+	}
+	for name := range weights {
+		if b.group(name) == nil {
+			return errors.New("backend " + b.NamedRoute + " has no target group " + name)
+		}
+	}
+	if total == 0 {
+		return errors.New("backend " + b.NamedRoute + ": target group weights add up to 0")
+	}
+
+	for _, g := range b.Groups {
+		if weight, ok := weights[g.Name]; ok {
+			g.Weight = weight
+		}
+	}
+	return nil
+}
+
+// groupWeights returns the current weight of every target group.
+func (b *Backend) groupWeights() map[string]int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	weights := make(map[string]int, len(b.Groups))
+	for _, g := range b.Groups {
+		weights[g.Name] = g.Weight
+	}
+	return weights
+}
+
+func (b *Backend) group(name string) *TargetGroup {
+	for _, g := range b.Groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// pickGroup chooses the target group for a request among those with a
+// healthy eligible target. Overrides win, then the group of the target an
+// affinity cookie names. Otherwise groups are picked by weight, at random
+// or, with hashing affinity, by the affinity key so a client stays in its
+// group as long as the weights don't change.
+func (b *Backend) pickGroup(r *http.Request, client string, eligible func(*Target) bool) *TargetGroup {
+	var available []*TargetGroup
+	for _, g := range b.Groups {
+		if len(b.candidates(g.Targets, eligible)) != 0 {
+			available = append(available, g)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	if name := b.overrideGroup(r); len(name) != 0 {
+		for _, g := range available {
+			if g.Name == name {
+				return g
+			}
+		}
+	}
+	for _, g := range available {
+		if b.affinityCookieTarget(r, g.Targets) != nil {
+			return g
+		}
+	}
+
+	weights := b.groupWeights()
+	total := 0
+	for _, g := range available {
+		total += weights[g.Name]
+	}
+	if total == 0 {
+		// only groups without weight are left, which beats failing
+		return available[0]
+	}
+
+	var n int
+	if key := b.affinityHashKey(r, client); len(key) != 0 {
+		n = int(hash64(key) % uint64(total))
+	} else {
+		n = rand.Intn(total)
+	}
+	for _, g := range available {
+		if n -= weights[g.Name]; n < 0 {
+			return g
+		}
+	}
+	return available[len(available)-1]
+}
+
+// overrideGroup returns the group a request asks for, if any.
+func (b *Backend) overrideGroup(r *http.Request) string {
+	o := b.GroupOverride
+	if o == nil || r == nil {
+		return ""
+	}
+	if len(o.Header) != 0 {
+		if name := r.Header.Get(o.Header); len(name) != 0 {
+			return name
+		}
+	}
+	if len(o.Cookie) != 0 {
+		if cookie, err := r.Cookie(o.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// allTargets returns the targets of a backend including those in groups.
+func (b *Backend) allTargets() []*Target {
+	if len(b.Groups) == 0 {
+		return b.targets()
+	}
+	var targets []*Target
+	for _, g := range b.Groups {
+		targets = append(targets, g.Targets...)
+	}
+	return targets
+}
+
+// groupStatus describes a target group in the admin API.
+type groupStatus struct {
+	Name    string    `json:"name"`
+	Weight  int       `json:"weight"`
+	Percent float64   `json:"percent"`
+	Targets []*Target `json:"targets"`
+}
+
+func (b *Backend) groupStatus() []groupStatus {
+	weights := b.groupWeights()
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	status := make([]groupStatus, 0, len(b.Groups))
+	for _, g := range b.Groups {
+		status = append(status, groupStatus{
+			Name:    g.Name,
+			Weight:  weights[g.Name],
+			Percent: 100 * float64(weights[g.Name]) / float64(total),
+			Targets: g.Targets,
+		})
+	}
+	return status
+}
@@ -0,0 +1,116 @@
+package holler
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// groupedProxy registers a backend at /grouped with a stable and a canary
+// group of one target each, weighted 95 and 5.
+func groupedProxy(t *testing.T, affinity *Affinity) (*HollerProxy, *Backend) {
+	h := newTestProxy(t)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	b := &Backend{
+		NamedRoute: "/grouped",
+		Groups: []*TargetGroup{
+			{Name: "stable", Weight: 95, Targets: []*Target{upstream(t, ok)}},
+			{Name: "canary", Weight: 5, Targets: []*Target{upstream(t, ok)}},
+		},
+		GroupOverride: &GroupOverride{Header: "X-Group"},
+		Affinity:      affinity,
+	}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return h, b
+}
+
+// canaryShare selects a target for n requests and returns the share that
+// went to the canary group.
+func canaryShare(t *testing.T, b *Backend, n int) float64 {
+	canary := 0
+	for i := 0; i < n; i++ {
+		target, err := b.selectTarget(nil, "10.0.0."+strconv.Itoa(i%250), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target == b.Groups[1].Targets[0] {
+			canary++
+		}
+	}
+	return float64(canary) / float64(n)
+}
+
+func TestGroupWeightSplit(t *testing.T) {
+	_, b := groupedProxy(t, nil)
+
+	if share := canaryShare(t, b, 20000); math.Abs(share-0.05) > 0.01 {
+		t.Errorf("canary got %.3f of the traffic, want 0.05", share)
+	}
+
+	if err := b.SetGroupWeights(map[string]int{"canary": 95}); err != nil {
+		t.Fatal(err)
+	}
+	if share := canaryShare(t, b, 20000); math.Abs(share-0.5) > 0.02 {
+		t.Errorf("canary got %.3f of the traffic after an even split, want 0.5", share)
+	}
+
+	// a group without healthy targets gets nothing
+	b.Groups[1].Targets[0].setHealthy(false)
+	if share := canaryShare(t, b, 1000); share != 0 {
+		t.Errorf("unhealthy canary got %.3f of the traffic", share)
+	}
+}
+
+func TestSetGroupWeightsRejects(t *testing.T) {
+	_, b := groupedProxy(t, nil)
+	for _, weights := range []map[string]int{
+		{"canary": -1},
+		{"preview": 10},
+		{"stable": 0, "canary": 0},
+	} {
+		if err := b.SetGroupWeights(weights); err == nil {
+			t.Errorf("%v: accepted", weights)
+		}
+	}
+	if w := b.groupWeights(); w["stable"] != 95 || w["canary"] != 5 {
+		t.Errorf("rejected update changed the weights to %v", w)
+	}
+}
+
+func TestGroupAffinityAndOverride(t *testing.T) {
+	h, b := groupedProxy(t, &Affinity{Mode: AffinityClientIP})
+
+	// with client_ip affinity a client always lands in the same group, and
+	// the clients still split by weight
+	canary := 0
+	for i := 0; i < 2000; i++ {
+		client := "10.1." + strconv.Itoa(i/250) + "." + strconv.Itoa(i%250)
+		first, _ := b.selectTarget(nil, client, nil)
+		for j := 0; j < 3; j++ {
+			if again, _ := b.selectTarget(nil, client, nil); again != first {
+				t.Fatalf("%s moved between groups", client)
+			}
+		}
+		if first == b.Groups[1].Targets[0] {
+			canary++
+		}
+	}
+	if share := float64(canary) / 2000; math.Abs(share-0.05) > 0.02 {
+		t.Errorf("canary got %.3f of the clients, want 0.05", share)
+	}
+
+	r := httptest.NewRequest("GET", "/grouped", nil)
+	r.Header.Set("X-Group", "canary")
+	for i := 0; i < 20; i++ {
+		if target, _ := b.selectTarget(r, "10.2.0."+strconv.Itoa(i), nil); target != b.Groups[1].Targets[0] {
+			t.Fatal("override header did not force the canary group")
+		}
+	}
+	if rec := serve(h, r); rec.Code != http.StatusOK {
+		t.Errorf("got %d through the override", rec.Code)
+	}
+}
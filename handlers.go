@@ -32,8 +32,7 @@ func pingHandler(h *HollerProxy) http.HandlerFunc {
 func registerBackendHandler(h *HollerProxy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
-			backends := h.Backends
-			json, err := json.Marshal(backends)
+			json, err := h.backendsJSON()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -44,15 +43,15 @@ func registerBackendHandler(h *HollerProxy) http.HandlerFunc {
 
 		backend, err := getBackendFromRequest(r)
 		if err != nil {
-			h.Log.Error(err)
+			h.logFor(r).Error(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		if r.Method == "DELETE" {
-			h.Log.Debugf("deleting backend %s", backend.NamedRoute)
+			h.logFor(r).Debugf("deleting backend %s", backend.NamedRoute)
 			if err := h.DeleteBackend(backend); err != nil {
-				h.Log.Error(err)
+				h.logFor(r).Error(err)
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
@@ -60,9 +59,9 @@ func registerBackendHandler(h *HollerProxy) http.HandlerFunc {
 			return
 		}
 
-		h.Log.Debugf("registering new backend %s", backend.NamedRoute)
+		h.logFor(r).Debugf("registering new backend %s", backend.NamedRoute)
 		if err := h.RegisterBackend(backend); err != nil {
-			h.Log.Error(err)
+			h.logFor(r).Error(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -84,3 +83,233 @@ func registeredBackendsHandler(h *HollerProxy) http.HandlerFunc {
 		})
 	}
 }
+
+// rateLimitsHandler shows (GET ?route=) or replaces (POST) the rate limits of
+// a registered backend. POST takes the backend's route and rate_limits in the
+// same JSON as /register/backend.
+func rateLimitsHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			backend, err := h.registeredBackend(r.URL.Query().Get("route"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			json, err := json.Marshal(backend.rateLimits())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(fmt.Sprintf("%s\n", json)))
+			return
+		}
+
+		update, err := getBackendFromRequest(r)
+		if err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		backend, err := h.registeredBackend(update.NamedRoute)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := backend.SetRateLimits(update.RateLimits); err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(fmt.Sprintf("updated rate limits for backend %s\n", backend.NamedRoute)))
+	}
+}
+
+// faultsHandler shows (GET ?route=) or replaces (POST) the fault injection
+// rules of a registered backend. POST takes the backend's route and faults in
+// the same JSON as /register/backend.
+func faultsHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			backend, err := h.registeredBackend(r.URL.Query().Get("route"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			json, err := json.Marshal(backend.faults())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(fmt.Sprintf("%s\n", json)))
+			return
+		}
+
+		update, err := getBackendFromRequest(r)
+		if err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		backend, err := h.registeredBackend(update.NamedRoute)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := backend.SetFaults(update.Faults); err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(fmt.Sprintf("updated faults for backend %s\n", backend.NamedRoute)))
+	}
+}
+
+// targetsHandler shows (GET ?route=) or replaces (POST) the targets of a
+// registered backend. POST takes the backend's route and targets in the same
+// JSON as /register/backend.
+func targetsHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			backend, err := h.registeredBackend(r.URL.Query().Get("route"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			json, err := json.Marshal(backend.targets())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(fmt.Sprintf("%s\n", json)))
+			return
+		}
+
+		update, err := getBackendFromRequest(r)
+		if err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		backend, err := h.registeredBackend(update.NamedRoute)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := backend.SetTargets(update.Targets); err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(fmt.Sprintf("updated targets for backend %s\n", backend.NamedRoute)))
+	}
+}
+
+// groupsHandler shows (GET ?route=) the target groups of a registered backend
+// with their share of traffic, or changes (POST) their weights. POST takes the
+// backend's route and groups, by name and weight, in the same JSON as
+// /register/backend.
+func groupsHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			backend, err := h.registeredBackend(r.URL.Query().Get("route"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			json, err := json.Marshal(backend.groupStatus())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(fmt.Sprintf("%s\n", json)))
+			return
+		}
+
+		update, err := getBackendFromRequest(r)
+		if err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		backend, err := h.registeredBackend(update.NamedRoute)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		weights := make(map[string]int, len(update.Groups))
+		for _, g := range update.Groups {
+			weights[g.Name] = g.Weight
+		}
+		if err := backend.SetGroupWeights(weights); err != nil {
+			h.logFor(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(fmt.Sprintf("updated group weights for backend %s\n", backend.NamedRoute)))
+	}
+}
+
+// canaryHandler shows the canary analysis of the backend named by the route
+// query parameter, with its decision log.
+func canaryHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backend, err := h.registeredBackend(r.URL.Query().Get("route"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if backend.canary == nil {
+			http.Error(w, "backend "+backend.NamedRoute+" has no canary analysis", http.StatusNotFound)
+			return
+		}
+
+		json, err := json.Marshal(backend.canary.snapshot())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("%s\n", json)))
+	}
+}
+
+// purgeCacheHandler removes cached responses of the backend named by the
+// route query parameter, either the one cached under key or every one whose
+// key starts with prefix. Keys are request URIs, such as /foo?page=2.
+func purgeCacheHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		backend, err := h.registeredBackend(query.Get("route"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		key, prefix := query.Get("key"), false
+		if p := query.Get("prefix"); len(p) != 0 {
+			key, prefix = p, true
+		}
+		if len(key) == 0 {
+			http.Error(w, "key or prefix is required", http.StatusBadRequest)
+			return
+		}
+
+		n, err := backend.purgeCache(key, prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("purged %d cached responses from backend %s\n", n, backend.NamedRoute)))
+	}
+}
@@ -0,0 +1,44 @@
+package holler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestBackendsListDuringUpdates(t *testing.T) {
+	h := newTestProxy(t)
+	a, b := upstream(t, nil), upstream(t, nil)
+	backend := &Backend{NamedRoute: "/listed", Groups: []*TargetGroup{
+		{Name: "stable", Weight: 1, Targets: []*Target{a}},
+		{Name: "canary", Weight: 1, Targets: []*Target{b}},
+	}}
+	if err := h.RegisterBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+
+	// the race detector catches a list that reads the backend while it changes
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			backend.SetGroupWeights(map[string]int{"canary": i%10 + 1})
+			backend.SetRateLimits([]*RateLimit{{Scope: RateLimitGlobal, Rate: float64(i + 1)}})
+			backend.SetFaults(nil)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		rec := serve(h, httptest.NewRequest("GET", "/register/backend", nil))
+		var listed map[string]*Backend
+		if err := json.Unmarshal(rec.Body.Bytes(), &listed); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("got %d %q: %v", rec.Code, rec.Body.String(), err)
+		}
+		if listed["/listed"] == nil || len(listed["/listed"].Groups) != 2 {
+			t.Fatalf("listed %s", rec.Body.String())
+		}
+	}
+	wg.Wait()
+}
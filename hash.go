@@ -0,0 +1,264 @@
+package holler
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultVirtualNodes    = 100
+	defaultMaglevTableSize = 65537
+)
+
+// HashConfig configures the ring_hash and maglev selectors. Key is the
+// request attribute hashed: client_ip (the default), path, uri, or one of
+// header:<name>, query:<name>, cookie:<name> or jwt:<claim>, falling back to
+// the client IP when the request has no such value. With a LoadFactor above
+// 1 no target is given more than LoadFactor times the average number of
+// active requests, scaled by its weight, the excess going on to the next
+// target for the key. VirtualNodes (default 100) is the number of ring points
+// of the heaviest targets, others getting fewer by weight, and TableSize
+// (default 65537) the size of the Maglev table, which must be a prime.
+type HashConfig struct {
+	Key          string  `json:"key,omitempty"`
+	LoadFactor   float64 `json:"load_factor,omitempty"`
+	VirtualNodes int     `json:"virtual_nodes,omitempty"`
+	TableSize    int     `json:"table_size,omitempty"`
+}
+
+func (c *HashConfig) validate(selector string) error {
+	switch kind, name := splitKey(c.Key); kind {
+	case "", "client_ip", "path", "uri":
+	case "header", "query", "cookie", "jwt":
+		if len(name) == 0 {
+			return errors.New("hash key " + c.Key + " has no name")
+		}
+	default:
+		return errors.New("unknown hash key " + c.Key)
+	}
+	if c.LoadFactor != 0 && c.LoadFactor <= 1 {
+		return errors.New("hash load_factor must be above 1")
+	}
+	if c.VirtualNodes <= 0 {
+		c.VirtualNodes = defaultVirtualNodes
+	}
+	if c.TableSize <= 0 {
+		c.TableSize = defaultMaglevTableSize
+	}
+	if selector == SelectorMaglev && !isPrime(c.TableSize) {
+		return errors.New("maglev table_size " + strconv.Itoa(c.TableSize) + " is not a prime")
+	}
+	return nil
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the value of the configured attribute for a selection.
+func (c *HashConfig) key(s *selection) string {
+	if s.r == nil {
+		return s.client
+	}
+	switch c.Key {
+	case "", "client_ip":
+		return s.client
+	case "path":
+		return s.r.URL.Path
+	case "uri":
+		return s.r.URL.RequestURI()
+	}
+	if value := requestKey(s.r, c.Key); len(value) != 0 {
+		return value
+	}
+	return s.client
+}
+
+// hash64 is FNV-1a with a final mix, as FNV alone spreads similar strings,
+// like target URLs differing in a port, poorly.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb34cc1e0ed7b
+	x ^= x >> 33
+	return x
+}
+
+// hashSelector is the ring_hash and maglev selector. Its ring or table is
+// built over all targets, giving each a share by weight, and rebuilt only
+// when they change, so targets going unhealthy or being skipped for a request
+// don't move other keys.
+type hashSelector struct {
+	config *HashConfig
+	maglev bool
+
+	mu      sync.Mutex
+	targets []*Target
+	weights []int
+	ring    []ringPoint
+	table   []*Target
+}
+
+type ringPoint struct {
+	hash   uint64
+	target *Target
+}
+
+func (h *hashSelector) pick(s *selection) *Target {
+	h.mu.Lock()
+	if !h.current(s.targets) {
+		h.build(s.targets)
+	}
+	ring, table := h.ring, h.table
+	h.mu.Unlock()
+
+	accept := acceptor(s.candidates, h.config.LoadFactor)
+	key := hash64(h.config.key(s))
+
+	if h.maglev {
+		for i := 0; i < len(table); i++ {
+			if t := table[(key+uint64(i))%uint64(len(table))]; accept(t) {
+				return t
+			}
+		}
+	} else {
+		start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= key })
+		for i := 0; i < len(ring); i++ {
+			if t := ring[(start+i)%len(ring)].target; accept(t) {
+				return t
+			}
+		}
+	}
+	return s.candidates[0]
+}
+
+// acceptor reports whether a target may take a request: it has to be a
+// candidate and, with bounded load, below its share of the active requests
+// by weight.
+func acceptor(candidates []*Target, loadFactor float64) func(*Target) bool {
+	var (
+		ok     = make(map[*Target]bool, len(candidates))
+		total  int64
+		weight int
+	)
+	for _, t := range candidates {
+		ok[t] = true
+		total += atomic.LoadInt64(&t.active)
+		weight += t.weight()
+	}
+	if loadFactor == 0 {
+		return func(t *Target) bool { return ok[t] }
+	}
+
+	perWeight := loadFactor * float64(total+1) / float64(weight)
+	return func(t *Target) bool {
+		capacity := int64(math.Ceil(perWeight * float64(t.weight())))
+		return ok[t] && atomic.LoadInt64(&t.active) < capacity
+	}
+}
+
+// current reports whether the ring or table was built for targets, with
+// their present weights.
+func (h *hashSelector) current(targets []*Target) bool {
+	if len(h.targets) != len(targets) {
+		return false
+	}
+	for i, t := range targets {
+		if h.targets[i] != t || h.weights[i] != t.weight() {
+			return false
+		}
+	}
+	return true
+}
+
+// build lays targets out on the ring or in the table by URL, so the layout
+// doesn't depend on their order, giving each room in proportion to its
+// weight.
+func (h *hashSelector) build(targets []*Target) {
+	h.targets = targets
+	h.weights = make([]int, len(targets))
+	h.ring, h.table = nil, nil
+	if len(targets) == 0 {
+		return
+	}
+
+	heaviest := 0
+	for i, t := range targets {
+		h.weights[i] = t.weight()
+		if h.weights[i] > heaviest {
+			heaviest = h.weights[i]
+		}
+	}
+
+	if !h.maglev {
+		for i, t := range targets {
+			points := h.config.VirtualNodes * h.weights[i] / heaviest
+			if points == 0 {
+				points = 1
+			}
+			for p := 0; p < points; p++ {
+				h.ring = append(h.ring, ringPoint{hash64(t.URL + "#" + strconv.Itoa(p)), t})
+			}
+		}
+		sort.Slice(h.ring, func(i, j int) bool { return h.ring[i].hash < h.ring[j].hash })
+		return
+	}
+
+	order := make([]int, len(targets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return targets[order[i]].URL < targets[order[j]].URL })
+
+	var (
+		m      = uint64(h.config.TableSize)
+		offset = make([]uint64, len(order))
+		skip   = make([]uint64, len(order))
+		next   = make([]uint64, len(order))
+		placed = make([]uint64, len(order))
+		table  = make([]*Target, m)
+	)
+	for i, o := range order {
+		offset[i] = hash64(targets[o].URL+"#offset") % m
+		skip[i] = hash64(targets[o].URL+"#skip")%(m-1) + 1
+	}
+	// in every round each target takes its next preferred slot, unless it
+	// already has more than its weight's share of the rounds so far
+	for filled, round := uint64(0), uint64(1); ; round++ {
+		for i, o := range order {
+			t := targets[o]
+			if placed[i]*uint64(heaviest) > round*uint64(h.weights[o]) {
+				continue
+			}
+			placed[i]++
+			c := (offset[i] + next[i]*skip[i]) % m
+			for table[c] != nil {
+				next[i]++
+				c = (offset[i] + next[i]*skip[i]) % m
+			}
+			table[c] = t
+			next[i]++
+			if filled++; filled == m {
+				h.table = table
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package holler
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func hashTargets(n int) []*Target {
+	targets := make([]*Target, n)
+	for i := range targets {
+		targets[i] = &Target{URL: "http://10.0.0." + strconv.Itoa(i+1) + ":8080", Healthy: true}
+	}
+	return targets
+}
+
+func newHashSelector(t *testing.T, selector string, config *HashConfig) *hashSelector {
+	if err := config.validate(selector); err != nil {
+		t.Fatal(err)
+	}
+	return &hashSelector{config: config, maglev: selector == SelectorMaglev}
+}
+
+// assign picks a target for each of n client IPs from candidates.
+func assign(h *hashSelector, targets, candidates []*Target, n int) map[string]*Target {
+	picks := make(map[string]*Target, n)
+	for i := 0; i < n; i++ {
+		client := "192.168." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		picks[client] = h.pick(&selection{targets: targets, candidates: candidates, client: client})
+	}
+	return picks
+}
+
+func TestRingHashRemapping(t *testing.T) {
+	targets := hashTargets(5)
+	h := newHashSelector(t, SelectorRingHash, &HashConfig{})
+	before := assign(h, targets, targets, 10000)
+
+	// an unhealthy target only moves its own keys
+	down := targets[2]
+	after := assign(h, targets, append(append([]*Target{}, targets[:2]...), targets[3:]...), 10000)
+	for client, target := range before {
+		if target != down && after[client] != target {
+			t.Fatalf("%s moved from %s to %s when %s went down", client, target.URL, after[client].URL, down.URL)
+		}
+		if after[client] == down {
+			t.Fatalf("%s still on unhealthy %s", client, down.URL)
+		}
+	}
+
+	// an added target only takes keys, about its share of them
+	grown := append(append([]*Target{}, targets...), &Target{URL: "http://10.0.0.6:8080", Healthy: true})
+	after = assign(h, grown, grown, 10000)
+	moved := 0
+	for client, target := range before {
+		if after[client] == target {
+			continue
+		}
+		moved++
+		if after[client] != grown[5] {
+			t.Fatalf("%s moved from %s to %s, not to the added target", client, target.URL, after[client].URL)
+		}
+	}
+	if share := float64(moved) / 10000; share < 0.08 || share > 0.27 {
+		t.Errorf("added target took %.2f of the keys, want about 1/6", share)
+	}
+}
+
+func TestRingHashWeights(t *testing.T) {
+	targets := hashTargets(2)
+	targets[1].Weight = 3
+	h := newHashSelector(t, SelectorRingHash, &HashConfig{})
+	h.build(targets)
+
+	points := map[*Target]int{}
+	for _, p := range h.ring {
+		points[p.target]++
+	}
+	if points[targets[0]] != 33 || points[targets[1]] != 100 {
+		t.Errorf("got %d and %d ring points, want 33 and 100", points[targets[0]], points[targets[1]])
+	}
+}
+
+func TestMaglevTable(t *testing.T) {
+	targets := hashTargets(4)
+	targets[3].Weight = 2
+	h := newHashSelector(t, SelectorMaglev, &HashConfig{TableSize: 10007})
+	h.build(targets)
+
+	slots := map[*Target]int{}
+	for i, target := range h.table {
+		if target == nil {
+			t.Fatalf("slot %d left empty", i)
+		}
+		slots[target]++
+	}
+	// weights 1, 1, 1 and 2 share the table in fifths
+	for i, target := range targets {
+		want := 10007.0 * float64(target.weight()) / 5
+		if math.Abs(float64(slots[target])-want) > want*0.01 {
+			t.Errorf("target %d got %d slots, want about %.0f", i, slots[target], want)
+		}
+	}
+
+	// the layout doesn't depend on the order of the targets
+	reversed := []*Target{targets[3], targets[2], targets[1], targets[0]}
+	other := newHashSelector(t, SelectorMaglev, &HashConfig{TableSize: 10007})
+	other.build(reversed)
+	for i := range h.table {
+		if h.table[i] != other.table[i] {
+			t.Fatalf("slot %d differs when the targets are reordered", i)
+		}
+	}
+}
+
+func TestMaglevRemapping(t *testing.T) {
+	targets := hashTargets(5)
+	h := newHashSelector(t, SelectorMaglev, &HashConfig{})
+	before := assign(h, targets, targets, 10000)
+
+	// rebuilding without a target keeps most keys of the others in place
+	remaining := targets[1:]
+	after := assign(h, remaining, remaining, 10000)
+	kept, total := 0, 0
+	for client, target := range before {
+		if target == targets[0] {
+			continue
+		}
+		total++
+		if after[client] == target {
+			kept++
+		}
+	}
+	if share := float64(kept) / float64(total); share < 0.9 {
+		t.Errorf("kept %.2f of the keys of remaining targets, want at least 0.9", share)
+	}
+}
+
+func TestBoundedLoadSpillover(t *testing.T) {
+	for _, selector := range []string{SelectorRingHash, SelectorMaglev} {
+		targets := hashTargets(3)
+		h := newHashSelector(t, selector, &HashConfig{LoadFactor: 1.25})
+		s := &selection{targets: targets, candidates: targets, client: "192.168.0.1"}
+
+		home := h.pick(s)
+		// 4 active requests and one more is a capacity of ceil(1.25*5/3) = 3
+		home.active = 3
+		targets[0].active++
+		if home == targets[0] {
+			targets[1].active++
+		}
+		spill := h.pick(s)
+		if spill == home {
+			t.Errorf("%s: target over its bound still picked", selector)
+		}
+		if again := h.pick(s); again != spill {
+			t.Errorf("%s: spillover is not consistent, got %s then %s", selector, spill.URL, again.URL)
+		}
+
+		// below the bound the key goes home again
+		home.active = 1
+		if got := h.pick(s); got != home {
+			t.Errorf("%s: key did not return to %s below the bound", selector, home.URL)
+		}
+	}
+}
+
+func TestHashConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		selector string
+		config   HashConfig
+	}{
+		{SelectorMaglev, HashConfig{TableSize: 100}},
+		{SelectorRingHash, HashConfig{LoadFactor: 1}},
+		{SelectorRingHash, HashConfig{Key: "header:"}},
+		{SelectorRingHash, HashConfig{Key: "body"}},
+	} {
+		if err := c.config.validate(c.selector); err == nil {
+			t.Errorf("%s %+v: validated", c.selector, c.config)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package holler
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderRules rewrite the headers of a request or response. Rules are applied
+// in the order rename, remove, set, add, and renames in the order of the
+// header they rename. Values may use the placeholders {client_ip},
+// {request_id}, {backend}, {target}, {host}, {method} and {path}, the path
+// being escaped.
+type HeaderRules struct {
+	Rename map[string]string `json:"rename,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+// apply rewrites header for the request r, which is the request being sent
+// upstream for both request and response rules.
+func (rules *HeaderRules) apply(header http.Header, r *http.Request) {
+	if rules == nil {
+		return
+	}
+
+	renames := make([]string, 0, len(rules.Rename))
+	for from := range rules.Rename {
+		renames = append(renames, from)
+	}
+	sort.Strings(renames)
+	for _, from := range renames {
+		to := rules.Rename[from]
+		if values, ok := header[http.CanonicalHeaderKey(from)]; ok {
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+
+	if len(rules.Set) == 0 && len(rules.Add) == 0 {
+		return
+	}
+
+	expand := headerTemplate(r)
+	for name, value := range rules.Set {
+		header.Set(name, expand.Replace(value))
+	}
+	for name, value := range rules.Add {
+		header.Add(name, expand.Replace(value))
+	}
+}
+
+// headerTemplate returns the replacer for header rule placeholders.
+func headerTemplate(r *http.Request) *strings.Replacer {
+	state := proxyStateFrom(r)
+
+	backend, client := "", clientIP(r)
+	if state.backend != nil {
+		backend, client = state.backend.NamedRoute, state.backend.clientAddr(r)
+	}
+
+	return strings.NewReplacer(
+		"{client_ip}", client,
+		"{request_id}", requestID(r),
+		"{backend}", backend,
+		"{target}", state.targetURL(),
+		"{host}", r.Host,
+		"{method}", r.Method,
+		"{path}", r.URL.EscapedPath(),
+	)
+}
@@ -0,0 +1,105 @@
+package holler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRulesOrder(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		rules  HeaderRules
+		header http.Header
+		want   http.Header
+	}{
+		{"renames in the order of the header they rename",
+			HeaderRules{Rename: map[string]string{"b": "C", "A": "b"}},
+			http.Header{"A": {"1"}, "B": {"2"}},
+			http.Header{"C": {"1"}}},
+		{"renames in the order of the header they rename, reversed",
+			HeaderRules{Rename: map[string]string{"B": "a", "A": "C"}},
+			http.Header{"A": {"1"}, "B": {"2"}},
+			http.Header{"A": {"2"}, "C": {"1"}}},
+		{"missing headers aren't renamed",
+			HeaderRules{Rename: map[string]string{"Missing": "Other"}},
+			http.Header{"A": {"1"}},
+			http.Header{"A": {"1"}}},
+		{"remove after rename",
+			HeaderRules{Rename: map[string]string{"A": "B"}, Remove: []string{"b"}},
+			http.Header{"A": {"1"}},
+			http.Header{}},
+		{"set after remove",
+			HeaderRules{Remove: []string{"A"}, Set: map[string]string{"A": "set"}},
+			http.Header{"A": {"1", "2"}},
+			http.Header{"A": {"set"}}},
+		{"add after set",
+			HeaderRules{Set: map[string]string{"A": "set"}, Add: map[string]string{"a": "added"}},
+			http.Header{"A": {"1"}},
+			http.Header{"A": {"set", "added"}}},
+	} {
+		// map order is random, so a rule order that depended on it would
+		// show up over a few runs
+		for i := 0; i < 20; i++ {
+			header := http.Header{}
+			for k, v := range c.header {
+				header[k] = append([]string(nil), v...)
+			}
+			c.rules.apply(header, httptest.NewRequest("GET", "/", nil))
+			if !reflect.DeepEqual(header, c.want) {
+				t.Errorf("%s: got %v, want %v", c.name, header, c.want)
+				break
+			}
+		}
+	}
+
+	var none *HeaderRules
+	header := http.Header{"A": {"1"}}
+	none.apply(header, httptest.NewRequest("GET", "/", nil))
+	if header.Get("A") != "1" {
+		t.Error("nil rules changed the header")
+	}
+}
+
+func TestHeaderRulePlaceholders(t *testing.T) {
+	h := newTestProxy(t)
+	var sent http.Header
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header
+	})
+	b := &Backend{
+		NamedRoute: "/rules/{rest:(?s).*}",
+		Targets:    []*Target{target},
+		Rewrites:   []*RewriteRule{{Match: "^/rules", Replace: "/up"}},
+		RequestHeaders: &HeaderRules{Set: map[string]string{
+			"X-Info": "{backend} {method} {host} {client_ip}",
+			"X-Path": "{path}",
+			"X-Id":   "{request_id}",
+		}},
+		ResponseHeaders: &HeaderRules{Add: map[string]string{"X-Target": "{target}"}},
+	}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/rules/a%0D%0Ab", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	rec := serve(h, r)
+
+	if got, want := sent.Get("X-Info"), "/rules/{rest:(?s).*} GET example.com 192.0.2.1"; got != want {
+		t.Errorf("X-Info: got %q, want %q", got, want)
+	}
+	// {path} is the upstream path, escaped so an encoded CR LF can't split
+	// the header
+	if got := sent.Get("X-Path"); got != "/up/a%0D%0Ab" || strings.ContainsAny(got, "\r\n") {
+		t.Errorf("X-Path: got %q", got)
+	}
+	if got := sent.Get("X-Id"); got != "abc" {
+		t.Errorf("X-Id: got %q", got)
+	}
+	if got := rec.Header().Get("X-Target"); got != target.URL {
+		t.Errorf("X-Target: got %q, want %q", got, target.URL)
+	}
+}
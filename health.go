@@ -1,43 +1,122 @@
 package holler
 
 import (
+	"errors"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 )
 
+const healthCheckTimeout = 5 * time.Second
+
+var errNoHealthRoute = errors.New("health route empty")
+
+// HealthSupervisor checks the targets of every registered backend on the
+// backend's HealthCheckInterval.
 func (h *HollerProxy) HealthSupervisor() {
-	var log = logrus.WithFields(logrus.Fields{"holler": "health"})
+	var (
+		log  = logrus.WithFields(logrus.Fields{"holler": "health"})
+		next = make(map[*Backend]time.Time)
+	)
+
 	for {
-		for name, backend := range h.Backends {
-			log.Debugf("executing health check for %s targets", name)
-
-			for _, target := range backend.Targets {
-				log.Debugf("checking %s target: %+v", name, target)
-
-				if len(target.HealthRoute) == 0 {
-					log.Warnf("%+v health route empty, ignoring", target)
-					break
-				}
-
-				client := &http.Client{}
-				resp, err := client.Head(target.URL)
-				if err != nil {
-					log.Error(err)
-					target.Healthy = false
-					break
-				}
-
-				if resp.StatusCode != 200 {
-					target.Healthy = false
-					log.Warnf("backend %s target %s unhealthy", name, target.URL)
-					break
-				}
-				log.Infof("target %s for backend %s is healthy", target.URL, name)
-				target.Healthy = true
+		now := time.Now()
+		for _, backend := range h.backendList() {
+			if now.Before(next[backend]) {
+				continue
 			}
-			time.Sleep(time.Duration(backend.HealthCheckInterval) * time.Second)
+			next[backend] = now.Add(time.Duration(backend.HealthCheckInterval) * time.Second)
+
+			log.Debugf("executing health check for %s targets", backend.NamedRoute)
+			h.checkBackend(backend, log)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (h *HollerProxy) checkBackend(backend *Backend, log *logrus.Entry) {
+	name := backend.NamedRoute
+	for _, target := range backend.healthTargets() {
+		log.Debugf("checking %s target: %+v", name, target)
+
+		start := time.Now()
+		err := backend.checkTarget(target)
+		if err == errNoHealthRoute {
+			log.Warnf("%+v health route empty, ignoring", target)
+			return
+		}
+		h.metrics.healthCheck.observe(time.Since(start).Seconds(), name, target.URL)
+
+		if err != nil {
+			target.setHealthy(false)
+			h.metrics.targetHealthy.set(0, name, target.URL)
+			log.Warnf("backend %s target %s unhealthy: %s", name, target.URL, err)
+			return
+		}
+
+		log.Infof("target %s for backend %s is healthy", target.URL, name)
+		if !target.healthy() {
+			target.warm(time.Now())
 		}
+		target.setHealthy(true)
+		h.metrics.targetHealthy.set(1, name, target.URL)
+	}
+}
+
+// healthTargets returns every target of a backend that is health checked,
+// including its mirror targets.
+func (b *Backend) healthTargets() []*Target {
+	targets := append([]*Target(nil), b.allTargets()...)
+	if b.Mirror != nil {
+		targets = append(targets, b.Mirror.Targets...)
+	}
+	return targets
+}
+
+// checkTarget probes a single target. HTTP targets with a health route must
+// answer a HEAD request with 200, tcp and tls targets must accept a connection.
+// UDP can't be probed generically, so udp targets are checked through their
+// health route, given as an http(s):// or tcp:// URL.
+func (b *Backend) checkTarget(target *Target) error {
+	switch b.Kind {
+	case KindTCP, KindTLS:
+		return dialCheck(targetAddr(target))
+	case KindUDP:
+		if len(target.HealthRoute) == 0 {
+			return errNoHealthRoute
+		}
+		if strings.HasPrefix(target.HealthRoute, "tcp://") {
+			return dialCheck(strings.TrimPrefix(target.HealthRoute, "tcp://"))
+		}
+		return headCheck(&http.Client{Timeout: healthCheckTimeout}, target.HealthRoute)
+	}
+
+	if len(target.HealthRoute) == 0 {
+		return errNoHealthRoute
+	}
+	return headCheck(&http.Client{}, target.URL)
+}
+
+func dialCheck(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func headCheck(client *http.Client, url string) error {
+	resp, err := client.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New("health check returned " + resp.Status)
 	}
+	return nil
 }
@@ -11,12 +11,20 @@ import (
 
 // HollerProxy abstracts the Holler application
 type HollerProxy struct {
-	Backends  map[string]*Backend
-	Port      string
-	Log       *logrus.Entry
-	LogLevel  logrus.Level
-	LogOutput io.Writer
-	Server    *http.Server
+	Backends        map[string]*Backend
+	Port            string
+	RequestIDHeader string
+	Log             *logrus.Entry
+	LogLevel        logrus.Level
+	LogOutput       io.Writer
+	Server          *http.Server
+	listeners       map[string]*l4Listener
+	// udp listeners are kept apart as they may share an address with tcp
+	udpListeners map[string]*udpListener
+	metrics      *hollerMetrics
+	accessLog    *accessLogger
+	tracer       *tracer
+	limiter      rateLimiter
 	sync.Mutex
 }
 
@@ -24,12 +32,17 @@ type HollerProxy struct {
 // functional options to override default configuration.
 func New(options ...Option) (*HollerProxy, error) {
 	defaultHoller := &HollerProxy{
-		Backends:  make(map[string]*Backend),
-		Port:      ":9000",
-		Log:       logrus.WithFields(logrus.Fields{"holler": "default"}),
-		LogLevel:  logrus.DebugLevel,
-		LogOutput: os.Stdout,
-		Server:    &http.Server{},
+		Backends:        make(map[string]*Backend),
+		Port:            ":9000",
+		RequestIDHeader: defaultRequestIDHeader,
+		Log:             logrus.WithFields(logrus.Fields{"holler": "default"}),
+		LogLevel:        logrus.DebugLevel,
+		LogOutput:       os.Stdout,
+		Server:          &http.Server{},
+		listeners:       make(map[string]*l4Listener),
+		udpListeners:    make(map[string]*udpListener),
+		metrics:         newHollerMetrics(),
+		limiter:         newLocalLimiter(),
 	}
 
 	for _, option := range options {
@@ -0,0 +1,37 @@
+package holler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// newTestProxy returns a HollerProxy serving its router without listening,
+// with logging silenced.
+func newTestProxy(t *testing.T, options ...Option) *HollerProxy {
+	logrus.SetOutput(ioutil.Discard)
+	h, err := New(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Server.Handler = newRouter(h)
+	return h
+}
+
+// serve sends r through the proxy's router and returns the response.
+func serve(h *HollerProxy, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.Server.Handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// upstream starts a server answering every request with handler, closed
+// when the test ends.
+func upstream(t *testing.T, handler http.HandlerFunc) *Target {
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	return &Target{URL: s.URL, Healthy: true}
+}
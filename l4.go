@@ -0,0 +1,277 @@
+package holler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	l4DialTimeout  = 5 * time.Second
+	l4HelloTimeout = 5 * time.Second
+)
+
+// l4Listener accepts connections on a single address for one tcp backend or
+// any number of tls passthrough backends keyed by server name.
+type l4Listener struct {
+	kind     string
+	ln       net.Listener
+	log      *logrus.Entry
+	metrics  *hollerMetrics
+	backends map[string]*Backend
+	sync.RWMutex
+}
+
+// startL4 binds the listen address of a tcp or tls backend, sharing an
+// existing tls listener when the address is already in use by one.
+// Callers must hold h.
+func (h *HollerProxy) startL4(b *Backend) error {
+	if len(b.Listen) == 0 {
+		return errors.New(b.Kind + " backend " + b.NamedRoute + " requires a listen address")
+	}
+
+	names := []string{""}
+	if b.Kind == KindTLS && len(b.ServerNames) != 0 {
+		names = b.ServerNames
+	}
+
+	if l, ok := h.listeners[b.Listen]; ok {
+		if l.kind != KindTLS || b.Kind != KindTLS {
+			return errors.New("listen address " + b.Listen + " already in use")
+		}
+		return l.add(b, names)
+	}
+
+	ln, err := net.Listen("tcp", b.Listen)
+	if err != nil {
+		return err
+	}
+
+	l := &l4Listener{
+		kind:     b.Kind,
+		ln:       ln,
+		log:      h.Log.WithFields(logrus.Fields{"listen": b.Listen, "kind": b.Kind}),
+		metrics:  h.metrics,
+		backends: make(map[string]*Backend),
+	}
+	if err := l.add(b, names); err != nil {
+		ln.Close()
+		return err
+	}
+	h.listeners[b.Listen] = l
+
+	go l.serve()
+	return nil
+}
+
+// stopL4 removes a tcp or tls backend from its listener, closing the listener
+// once no backends remain on it. Callers must hold h.
+func (h *HollerProxy) stopL4(b *Backend) error {
+	l, ok := h.listeners[b.Listen]
+	if !ok {
+		return errors.New("no listener on " + b.Listen + " for backend " + b.NamedRoute)
+	}
+
+	if l.remove(b) == 0 {
+		delete(h.listeners, b.Listen)
+		return l.ln.Close()
+	}
+	return nil
+}
+
+func (l *l4Listener) add(b *Backend, names []string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if existing, ok := l.backends[name]; ok {
+			return errors.New("server name " + name + " on " + b.Listen + " already routed to " + existing.NamedRoute)
+		}
+	}
+	for _, name := range names {
+		l.backends[strings.ToLower(name)] = b
+	}
+	return nil
+}
+
+// remove drops every server name routed to b and returns the number of
+// names left on the listener.
+func (l *l4Listener) remove(b *Backend) int {
+	l.Lock()
+	defer l.Unlock()
+
+	for name, routed := range l.backends {
+		if routed == b {
+			delete(l.backends, name)
+		}
+	}
+	return len(l.backends)
+}
+
+// match returns the backend for a server name, trying an exact match, then
+// a "*.domain" wildcard, then the default backend registered without names.
+func (l *l4Listener) match(serverName string) *Backend {
+	l.RLock()
+	defer l.RUnlock()
+
+	serverName = strings.ToLower(serverName)
+	if b, ok := l.backends[serverName]; ok {
+		return b
+	}
+	if i := strings.Index(serverName, "."); i > 0 {
+		if b, ok := l.backends["*"+serverName[i:]]; ok {
+			return b
+		}
+	}
+	return l.backends[""]
+}
+
+func (l *l4Listener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.log.Warn(err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			l.log.Debugf("listener stopped: %s", err)
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *l4Listener) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		client     io.Reader = conn
+		serverName string
+	)
+
+	if l.kind == KindTLS {
+		conn.SetReadDeadline(time.Now().Add(l4HelloTimeout))
+		name, replay, err := peekServerName(conn)
+		if err != nil {
+			l.log.Debugf("reading client hello from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		client, serverName = replay, name
+	}
+
+	b := l.match(serverName)
+	if b == nil {
+		l.log.Warnf("no backend for server name %q from %s", serverName, conn.RemoteAddr())
+		return
+	}
+
+	target, err := b.selectTarget(nil, addrIP(conn.RemoteAddr()), nil)
+	if err != nil {
+		l.log.Errorf("backend %s: %s", b.NamedRoute, err)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", targetAddr(target), l4DialTimeout)
+	if err != nil {
+		l.log.Errorf("backend %s: %s", b.NamedRoute, err)
+		return
+	}
+	defer upstream.Close()
+
+	l.log.Debugf("proxying %s to %s for backend %s", conn.RemoteAddr(), upstream.RemoteAddr(), b.NamedRoute)
+	l.metrics.connections.add(1, b.NamedRoute, target.URL)
+	atomic.AddInt64(&target.active, 1)
+	defer atomic.AddInt64(&target.active, -1)
+
+	in, out := pipe(conn, client, upstream)
+	l.metrics.bytesIn.add(float64(in), b.NamedRoute, target.URL)
+	l.metrics.bytesOut.add(float64(out), b.NamedRoute, target.URL)
+}
+
+// pipe copies in both directions until each side has finished sending and
+// returns the bytes received from and sent to the client.
+// client is read from rather than conn so that peeked bytes are replayed.
+func pipe(conn net.Conn, client io.Reader, upstream net.Conn) (int64, int64) {
+	var in, out int64
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst net.Conn, src io.Reader, n *int64) {
+		*n, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+
+	go copyHalf(upstream, client, &in)
+	go copyHalf(conn, upstream, &out)
+	<-done
+	<-done
+	return in, out
+}
+
+// targetAddr returns the host:port to dial for a target. L4 targets may be
+// given as tcp://host:port or as a bare host:port.
+func targetAddr(t *Target) string {
+	if u, err := url.Parse(t.URL); err == nil && len(u.Host) != 0 {
+		return u.Host
+	}
+	return t.URL
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the TLS ClientHello from r and returns its SNI server
+// name along with a reader that replays the consumed bytes before the rest of
+// the stream. crypto/tls does the parsing; the handshake is abandoned as soon
+// as the hello has been seen.
+func peekServerName(r io.Reader) (string, io.Reader, error) {
+	var (
+		peeked     bytes.Buffer
+		serverName string
+		seen       bool
+	)
+
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, seen = hello.ServerName, true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !seen {
+		return "", nil, err
+	}
+
+	return serverName, io.MultiReader(&peeked, r), nil
+}
+
+// readOnlyConn lets crypto/tls read a ClientHello without being able to
+// answer it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
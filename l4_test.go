@@ -0,0 +1,191 @@
+package holler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// tcpUpstream starts a listener handling each connection with handle, closed
+// when the test ends.
+func tcpUpstream(t *testing.T, handle func(net.Conn)) *Target {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return &Target{URL: "tcp://" + ln.Addr().String(), Healthy: true}
+}
+
+// registerL4 registers b and removes it again when the test ends.
+func registerL4(t *testing.T, h *HollerProxy, b *Backend) {
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.DeleteBackend(b) })
+}
+
+func TestTCPProxy(t *testing.T) {
+	h := newTestProxy(t)
+	echo := tcpUpstream(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	b := &Backend{NamedRoute: "echo", Kind: KindTCP, Listen: freeAddr(t), Targets: []*Target{echo}}
+	registerL4(t, h, b)
+
+	conn, err := net.Dial("tcp", b.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	payload := bytes.Repeat([]byte("holler"), 10000)
+	go func() {
+		conn.Write(payload)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %d bytes back, want the %d sent", len(got), len(payload))
+	}
+}
+
+// clientHello returns the first TLS record a client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	record, err := readRecord(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return record
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	_, err := io.ReadFull(r, record[5:])
+	return record, err
+}
+
+// namedUpstream answers a connection with its name once it has read a
+// ClientHello, so tests see which backend a hello was routed to and that
+// the peeked bytes reached it.
+func namedUpstream(t *testing.T, name string, hellos chan []byte) *Target {
+	return tcpUpstream(t, func(conn net.Conn) {
+		record, err := readRecord(conn)
+		if err != nil {
+			return
+		}
+		hellos <- record
+		conn.Write([]byte(name))
+	})
+}
+
+func TestTLSServerNameRouting(t *testing.T) {
+	h := newTestProxy(t)
+	hellos := make(chan []byte, 1)
+	shared, alone := freeAddr(t), freeAddr(t)
+	for _, b := range []*Backend{
+		{NamedRoute: "exact", ServerNames: []string{"api.example.com"}, Listen: shared},
+		{NamedRoute: "wildcard", ServerNames: []string{"*.example.com"}, Listen: shared},
+		{NamedRoute: "default", Listen: shared},
+		{NamedRoute: "alone", ServerNames: []string{"only.example.org"}, Listen: alone},
+	} {
+		b.Kind = KindTLS
+		b.Targets = []*Target{namedUpstream(t, b.NamedRoute, hellos)}
+		registerL4(t, h, b)
+	}
+
+	for _, c := range []struct {
+		listen, serverName, want string
+	}{
+		{shared, "api.example.com", "exact"},
+		{shared, "API.Example.COM", "exact"},
+		{shared, "www.example.com", "wildcard"},
+		{shared, "example.com", "default"},
+		{shared, "unknown.example.net", "default"},
+		{shared, "", "default"},
+		{alone, "only.example.org", "alone"},
+		{alone, "unknown.example.net", ""},
+		{alone, "", ""},
+	} {
+		hello := clientHello(t, c.serverName)
+		conn, err := net.Dial("tcp", c.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(hello)
+		got, _ := ioutil.ReadAll(conn)
+		conn.Close()
+
+		if string(got) != c.want {
+			t.Errorf("%q: routed to %q, want %q", c.serverName, got, c.want)
+			continue
+		}
+		if len(c.want) == 0 {
+			continue
+		}
+		if replayed := <-hellos; !bytes.Equal(replayed, hello) {
+			t.Errorf("%q: upstream got a different client hello than was sent", c.serverName)
+		}
+	}
+}
+
+func TestTLSRejectsNonTLS(t *testing.T) {
+	h := newTestProxy(t)
+	hellos := make(chan []byte, 1)
+	b := &Backend{NamedRoute: "default", Kind: KindTLS, Listen: freeAddr(t)}
+	b.Targets = []*Target{namedUpstream(t, b.NamedRoute, hellos)}
+	registerL4(t, h, b)
+
+	conn, err := net.Dial("tcp", b.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if got, _ := ioutil.ReadAll(conn); len(got) != 0 {
+		t.Errorf("plain HTTP was proxied to %q", got)
+	}
+}
@@ -0,0 +1,250 @@
+package holler
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultBuckets are the Prometheus client default latency buckets in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricVec is a family of series sharing a name and label names, rendered in
+// the Prometheus text exposition format.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+	sync.Mutex
+}
+
+type series struct {
+	labels []string
+	value  float64
+	// histograms only
+	counts []uint64
+	count  uint64
+}
+
+func newVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func (v *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if v.kind == "histogram" {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// add increments a counter or gauge series.
+func (v *metricVec) add(delta float64, values ...string) {
+	v.Lock()
+	v.get(values).value += delta
+	v.Unlock()
+}
+
+// set overwrites a gauge series.
+func (v *metricVec) set(value float64, values ...string) {
+	v.Lock()
+	v.get(values).value = value
+	v.Unlock()
+}
+
+// observe records a histogram sample.
+func (v *metricVec) observe(value float64, values ...string) {
+	v.Lock()
+	s := v.get(values)
+	for i, upper := range v.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+	v.Unlock()
+}
+
+// forget drops every series whose first label value is first, used to stop
+// reporting a backend once it is deleted.
+func (v *metricVec) forget(first string) {
+	v.Lock()
+	for key, s := range v.series {
+		if len(s.labels) != 0 && s.labels[0] == first {
+			delete(v.series, key)
+		}
+	}
+	v.Unlock()
+}
+
+func (v *metricVec) write(buf *bytes.Buffer) {
+	v.Lock()
+	defer v.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", v.name, labelString(v.labels, s.labels, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range v.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, labelString(v.labels, s.labels, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, labelString(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", v.name, labelString(v.labels, s.labels, "", ""), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", v.name, labelString(v.labels, s.labels, "", ""), s.count)
+	}
+}
+
+// labelEscaper escapes label values as the text format requires, which only
+// knows backslash, double quote and line feed escapes.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extraName) != 0 {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// hollerMetrics holds every metric family holler exports on /metrics.
+type hollerMetrics struct {
+	requests         *metricVec
+	duration         *metricVec
+	inFlight         *metricVec
+	bytesIn          *metricVec
+	bytesOut         *metricVec
+	connections      *metricVec
+	targetHealthy    *metricVec
+	healthCheck      *metricVec
+	retries          *metricVec
+	rateLimited      *metricVec
+	shed             *metricVec
+	cache            *metricVec
+	coalesced        *metricVec
+	mirrored         *metricVec
+	faults           *metricVec
+	concurrencyLimit *metricVec
+	registrations    *metricVec
+	storeErrors      *metricVec
+	perBackendFamily []*metricVec
+	all              []*metricVec
+}
+
+func newHollerMetrics() *hollerMetrics {
+	m := &hollerMetrics{
+		requests:         newVec("counter", "holler_requests_total", "Proxied HTTP requests by backend, target and status class.", "backend", "target", "code"),
+		duration:         newVec("histogram", "holler_request_duration_seconds", "Latency of proxied HTTP requests.", "backend", "target"),
+		inFlight:         newVec("gauge", "holler_requests_in_flight", "Proxied HTTP requests currently being served.", "backend"),
+		bytesIn:          newVec("counter", "holler_received_bytes_total", "Bytes received from clients.", "backend", "target"),
+		bytesOut:         newVec("counter", "holler_sent_bytes_total", "Bytes sent to clients.", "backend", "target"),
+		connections:      newVec("counter", "holler_connections_total", "Connections or sessions proxied by tcp, tls and udp backends.", "backend", "target"),
+		targetHealthy:    newVec("gauge", "holler_target_healthy", "Whether the last health check of a target passed.", "backend", "target"),
+		healthCheck:      newVec("histogram", "holler_health_check_duration_seconds", "Duration of target health checks.", "backend", "target"),
+		retries:          newVec("counter", "holler_retries_total", "Upstream requests the transport retried on a new connection.", "backend"),
+		rateLimited:      newVec("counter", "holler_rate_limited_total", "Requests rejected by a rate limit.", "backend"),
+		shed:             newVec("counter", "holler_shed_requests_total", "Requests rejected by a concurrency limit.", "backend", "reason"),
+		cache:            newVec("counter", "holler_cache_requests_total", "Cache lookups by result: hit, miss, stale, revalidate or bypass.", "backend", "result"),
+		coalesced:        newVec("counter", "holler_coalesced_requests_total", "Coalescing outcomes: leader, joined, timeout, overflow, failed or vary.", "backend", "result"),
+		mirrored:         newVec("counter", "holler_mirrored_requests_total", "Mirrored requests by status class, or error, dropped, body_too_large or no_target.", "backend", "result"),
+		faults:           newVec("counter", "holler_faults_injected_total", "Injected faults: delay, abort or reset.", "backend", "fault"),
+		concurrencyLimit: newVec("gauge", "holler_concurrency_limit", "Current concurrency limit of a backend.", "backend"),
+		registrations:    newVec("counter", "holler_backend_registrations_total", "Backend registration events.", "event"),
+		storeErrors:      newVec("counter", "holler_rate_limit_store_errors_total", "Failed calls to the shared rate limit store."),
+	}
+	m.duration.buckets = defaultBuckets
+	m.healthCheck.buckets = defaultBuckets
+
+	m.perBackendFamily = []*metricVec{
+		m.requests, m.duration, m.inFlight, m.bytesIn, m.bytesOut,
+		m.connections, m.targetHealthy, m.healthCheck, m.retries,
+		m.rateLimited, m.shed, m.concurrencyLimit, m.cache, m.coalesced,
+		m.mirrored, m.faults,
+	}
+	m.all = append(m.perBackendFamily, m.registrations, m.storeErrors)
+	return m
+}
+
+// forgetBackend stops reporting series for a deleted backend.
+func (m *hollerMetrics) forgetBackend(name string) {
+	for _, v := range m.perBackendFamily {
+		v.forget(name)
+	}
+}
+
+func (m *hollerMetrics) write(buf *bytes.Buffer) {
+	for _, v := range m.all {
+		v.write(buf)
+	}
+}
+
+func metricsHandler(h *HollerProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		h.metrics.write(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	}
+}
+
+// statusClass buckets a status code into 1xx..5xx.
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// observeRequest records a finished proxied request.
+func (m *hollerMetrics) observeRequest(state *proxyState) {
+	name, target := state.backend.NamedRoute, state.targetURL()
+	m.requests.add(1, name, target, statusClass(state.status))
+	m.duration.observe(state.duration.Seconds(), name, target)
+	m.bytesIn.add(float64(state.bytesIn), name, target)
+	m.bytesOut.add(float64(state.bytesOut), name, target)
+}
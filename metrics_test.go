@@ -0,0 +1,114 @@
+package holler
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func scrape(t *testing.T, h *HollerProxy) string {
+	rec := serve(h, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("got %d with content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	return rec.Body.String()
+}
+
+func TestMetricsScrape(t *testing.T) {
+	h := newTestProxy(t)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("ok"))
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/metered", Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/metered", "/metered", "/metered?fail=1"} {
+		serve(h, httptest.NewRequest("GET", url, nil))
+	}
+
+	labels := `{backend="/metered",target="` + target.URL + `"`
+	body := scrape(t, h)
+	for _, line := range []string{
+		"# HELP holler_requests_total Proxied HTTP requests by backend, target and status class.",
+		"# TYPE holler_requests_total counter",
+		"holler_requests_total" + labels + `,code="2xx"} 2`,
+		"holler_requests_total" + labels + `,code="5xx"} 1`,
+		"# TYPE holler_request_duration_seconds histogram",
+		"holler_request_duration_seconds_bucket" + labels + `,le="+Inf"} 3`,
+		"holler_request_duration_seconds_count" + labels + `} 3`,
+		"holler_sent_bytes_total" + labels + `} 6`,
+		`holler_requests_in_flight{backend="/metered"} 0`,
+		`holler_backend_registrations_total{event="register"} 1`,
+		"# TYPE holler_retries_total counter",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("scrape is missing %q", line)
+		}
+	}
+	if strings.Contains(body, "holler_retries_total{") {
+		t.Error("retries reported without a retried request")
+	}
+
+	if err := h.DeleteBackend(h.Backends["/metered"]); err != nil {
+		t.Fatal(err)
+	}
+	body = scrape(t, h)
+	if strings.Contains(body, `backend="/metered"`) {
+		t.Error("series of a deleted backend still reported")
+	}
+	if !strings.Contains(body, `holler_backend_registrations_total{event="delete"} 1`+"\n") {
+		t.Error("delete not counted")
+	}
+}
+
+func TestMetricsRetries(t *testing.T) {
+	h := newTestProxy(t)
+
+	// the first connection answers one request and then closes without
+	// answering the next, which http.Transport retries on a new connection
+	var conns int32
+	target := tcpUpstream(t, func(conn net.Conn) {
+		answer := 2
+		if atomic.AddInt32(&conns, 1) == 1 {
+			answer = 1
+		}
+		r := bufio.NewReader(conn)
+		for i := 0; i < answer; i++ {
+			if _, err := http.ReadRequest(r); err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+		http.ReadRequest(r)
+	})
+	target.URL = "http://" + strings.TrimPrefix(target.URL, "tcp://")
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/retried", Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(h, httptest.NewRequest("GET", "/retried", nil)); rec.Code != http.StatusOK {
+			t.Fatalf("request %d got %d", i, rec.Code)
+		}
+	}
+	if body := scrape(t, h); !strings.Contains(body, `holler_retries_total{backend="/retried"} 1`+"\n") {
+		t.Errorf("retry not counted in\n%s", body)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	got := labelString([]string{"backend"}, []string{"a\\b\"c\nd\té"}, "le", "1")
+	if want := `{backend="a\\b\"c\nd` + "\t" + `é",le="1"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := labelString(nil, nil, "", ""); got != "" {
+		t.Errorf("got %q without labels", got)
+	}
+}
@@ -0,0 +1,204 @@
+package holler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMirrorMaxBodyBytes = 64 << 10
+	defaultMirrorTimeout      = 5000
+	defaultMirrorMaxInFlight  = 100
+)
+
+// hopHeaders are removed from mirrored requests, as they only apply to the
+// client's connection.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// MirrorConfig copies Percent of a backend's requests to a shadow group of
+// Targets. Mirrored requests are sent in the background, their responses are
+// discarded and their failures never reach the client. Request bodies are
+// buffered up to MaxBodyBytes (default 64KB) to be sent twice; larger
+// requests are not mirrored. At most MaxInFlight (default 100) mirrored
+// requests are outstanding at once, each for up to TimeoutMS milliseconds
+// (default 5000), and requests over that are not mirrored either.
+type MirrorConfig struct {
+	Percent      float64   `json:"percent"`
+	Targets      []*Target `json:"targets"`
+	MaxBodyBytes int64     `json:"max_body_bytes,omitempty"`
+	TimeoutMS    int       `json:"timeout_ms,omitempty"`
+	MaxInFlight  int       `json:"max_in_flight,omitempty"`
+}
+
+type mirror struct {
+	config   *MirrorConfig
+	selector targetSelector
+	client   *http.Client
+	slots    chan struct{}
+}
+
+func newMirror(config *MirrorConfig) (*mirror, error) {
+	if config.Percent <= 0 || config.Percent > 100 {
+		return nil, errors.New("mirror percent must be above 0 and at most 100")
+	}
+	if len(config.Targets) == 0 {
+		return nil, errors.New("mirror requires targets")
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+	if config.TimeoutMS <= 0 {
+		config.TimeoutMS = defaultMirrorTimeout
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = defaultMirrorMaxInFlight
+	}
+
+	return &mirror{
+		config:   config,
+		selector: &roundRobinSelector{},
+		client: &http.Client{
+			Timeout: time.Duration(config.TimeoutMS) * time.Millisecond,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		slots: make(chan struct{}, config.MaxInFlight),
+	}, nil
+}
+
+// detached carries the values of a request's context, such as its ID, without
+// its cancellation, so mirrored requests outlive the client's.
+type detached struct {
+	context.Context
+	values context.Context
+}
+
+func (d detached) Value(key interface{}) interface{} {
+	return d.values.Value(key)
+}
+
+// mirror wraps the handler of an http backend, copying sampled requests to
+// its shadow targets.
+func (h *HollerProxy) mirror(inner http.Handler, b *Backend) http.Handler {
+	if b.mirror == nil {
+		return inner
+	}
+	m := b.mirror
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 >= m.config.Percent {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := m.bufferBody(r)
+		if !ok {
+			h.metrics.mirrored.add(1, b.NamedRoute, "body_too_large")
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case m.slots <- struct{}{}:
+			shadow, target, err := m.request(r, b, body)
+			if err != nil {
+				<-m.slots
+				h.logFor(r).Debugf("backend %s not mirroring request: %s", b.NamedRoute, err)
+				h.metrics.mirrored.add(1, b.NamedRoute, "no_target")
+				break
+			}
+			go func() {
+				defer func() { <-m.slots }()
+				h.sendMirror(b, shadow, target)
+			}()
+		default:
+			h.metrics.mirrored.add(1, b.NamedRoute, "dropped")
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// bufferBody reads the request body so it can be sent twice, leaving r with an
+// equivalent body. It reports false when the body is over the limit, in which
+// case r keeps its body unread past the limit.
+func (m *mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.config.MaxBodyBytes {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, m.config.MaxBodyBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || int64(len(body)) > m.config.MaxBodyBytes {
+		return nil, false
+	}
+	return body, true
+}
+
+// request builds the shadow copy of r for a healthy mirror target.
+func (m *mirror) request(r *http.Request, b *Backend, body []byte) (*http.Request, *Target, error) {
+	var candidates []*Target
+	for _, t := range m.config.Targets {
+		if t.healthy() {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, errNoHealthyTargets
+	}
+	target := m.selector.pick(&selection{targets: m.config.Targets, candidates: candidates})
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := proxyStateFrom(r)
+	ctx := detached{Context: context.Background(), values: r.Context()}
+	shadow := r.Clone(context.WithValue(ctx, proxyStateKey, &proxyState{
+		backend: b,
+		target:  target,
+		start:   time.Now(),
+		id:      state.id,
+	}))
+	shadow.RequestURI = ""
+	shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		shadow.Body = http.NoBody
+	}
+	for _, name := range hopHeaders {
+		shadow.Header.Del(name)
+	}
+	b.prepareUpstream(shadow, targetURL)
+	return shadow, target, nil
+}
+
+func (h *HollerProxy) sendMirror(b *Backend, shadow *http.Request, target *Target) {
+	resp, err := b.mirror.client.Do(shadow)
+	if err != nil {
+		h.logFor(shadow).Debugf("mirroring to %s for backend %s: %s", target.URL, b.NamedRoute, err)
+		h.metrics.mirrored.add(1, b.NamedRoute, "error")
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	h.metrics.mirrored.add(1, b.NamedRoute, statusClass(resp.StatusCode))
+}
@@ -0,0 +1,138 @@
+package holler
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mirroredProxy registers a backend at /mirrored whose target echoes request
+// bodies, mirroring with config to a target handled by shadow.
+func mirroredProxy(t *testing.T, config *MirrorConfig, shadow http.HandlerFunc) (*HollerProxy, *Backend) {
+	h := newTestProxy(t)
+	primary := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	config.Targets = append(config.Targets, upstream(t, shadow))
+	b := &Backend{NamedRoute: "/mirrored", Mirror: config, Targets: []*Target{primary}}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return h, b
+}
+
+// settle waits for the mirrored requests of b to finish.
+func settle(t *testing.T, b *Backend) {
+	waitFor(t, "mirrored requests", func() bool { return len(b.mirror.slots) == 0 })
+}
+
+func post(h *HollerProxy, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/mirrored", strings.NewReader(body))
+	// a body of unknown length has to be read to learn whether it fits
+	r.ContentLength = -1
+	return serve(h, r)
+}
+
+func TestMirrorPercent(t *testing.T) {
+	for _, percent := range []float64{10, 50, 100} {
+		var shadowed int32
+		h, b := mirroredProxy(t, &MirrorConfig{Percent: percent, MaxInFlight: 5000}, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&shadowed, 1)
+		})
+		for i := 0; i < 1000; i++ {
+			serve(h, httptest.NewRequest("GET", "/mirrored", nil))
+		}
+		settle(t, b)
+		if share := float64(atomic.LoadInt32(&shadowed)) / 1000; math.Abs(share-percent/100) > 0.05 {
+			t.Errorf("percent %.0f mirrored %.3f of the requests", percent, share)
+		}
+	}
+}
+
+func TestMirrorBody(t *testing.T) {
+	shadowBodies := make(chan string, 2)
+	h, b := mirroredProxy(t, &MirrorConfig{Percent: 100, MaxBodyBytes: 16}, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		shadowBodies <- string(body)
+	})
+
+	small := "0123456789"
+	if rec := post(h, small); rec.Body.String() != small {
+		t.Errorf("primary got %q, want %q", rec.Body.String(), small)
+	}
+	settle(t, b)
+	if got := <-shadowBodies; got != small {
+		t.Errorf("shadow got %q, want %q", got, small)
+	}
+
+	// over the limit the primary still gets all of the body, including the
+	// part read while checking its size, and nothing is mirrored
+	large := strings.Repeat("0123456789", 10)
+	if rec := post(h, large); rec.Body.String() != large {
+		t.Errorf("primary got %d bytes of a %d byte body", rec.Body.Len(), len(large))
+	}
+	settle(t, b)
+	select {
+	case got := <-shadowBodies:
+		t.Errorf("body over the limit was mirrored as %q", got)
+	default:
+	}
+	if body := scrape(t, h); !strings.Contains(body, `holler_mirrored_requests_total{backend="/mirrored",result="body_too_large"} 1`+"\n") {
+		t.Error("body over the limit not counted")
+	}
+}
+
+func TestMirrorMaxInFlight(t *testing.T) {
+	var shadowed int32
+	release := make(chan struct{})
+	h, b := mirroredProxy(t, &MirrorConfig{Percent: 100, MaxInFlight: 1}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&shadowed, 1)
+		<-release
+	})
+
+	for i := 0; i < 3; i++ {
+		if rec := serve(h, httptest.NewRequest("GET", "/mirrored", nil)); rec.Code != http.StatusOK {
+			t.Errorf("request %d got %d", i, rec.Code)
+		}
+	}
+	close(release)
+	settle(t, b)
+	if n := atomic.LoadInt32(&shadowed); n != 1 {
+		t.Errorf("mirrored %d requests with one slot, want 1", n)
+	}
+	if body := scrape(t, h); !strings.Contains(body, `holler_mirrored_requests_total{backend="/mirrored",result="dropped"} 2`+"\n") {
+		t.Error("dropped mirrors not counted")
+	}
+}
+
+func TestMirrorFailuresHidden(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		shadow http.HandlerFunc
+	}{
+		{"error status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"dropped connection", func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}},
+		{"slower than the timeout", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}},
+	} {
+		h, b := mirroredProxy(t, &MirrorConfig{Percent: 100, TimeoutMS: 50}, c.shadow)
+
+		start := time.Now()
+		rec := post(h, "payload")
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" || time.Since(start) > 150*time.Millisecond {
+			t.Errorf("%s: client got %d %q after %s", c.name, rec.Code, rec.Body.String(), time.Since(start))
+		}
+		settle(t, b)
+	}
+}
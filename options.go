@@ -56,3 +56,69 @@ func HollerBackends(backends map[string]*Backend) Option {
 		return nil
 	}
 }
+
+// HollerAccessLog enables access logging of proxied requests. See
+// AccessLogConfig for the available formats, rotation and sampling.
+func HollerAccessLog(config AccessLogConfig) Option {
+	return func(h *HollerProxy) error {
+		accessLog, err := newAccessLogger(config)
+		if err != nil {
+			return err
+		}
+		h.accessLog = accessLog
+		return nil
+	}
+}
+
+// HollerTracing enables W3C Trace Context propagation and exports spans for
+// every proxied request to an OTLP/HTTP collector.
+func HollerTracing(config TracingConfig) Option {
+	return func(h *HollerProxy) error {
+		exporter, err := NewOTLPExporter(config)
+		if err != nil {
+			return err
+		}
+		sampleRatio := 1.0
+		if config.SampleRatio != nil {
+			sampleRatio = *config.SampleRatio
+		}
+		h.tracer = &tracer{exporter: exporter, sampleRatio: sampleRatio}
+		return nil
+	}
+}
+
+// HollerTraceExporter enables tracing with your own SpanExporter, such as an
+// InMemoryExporter in tests.
+func HollerTraceExporter(exporter SpanExporter, sampleRatio float64) Option {
+	return func(h *HollerProxy) error {
+		if exporter == nil {
+			return errors.New("trace exporter option can not be nil")
+		}
+		h.tracer = &tracer{exporter: exporter, sampleRatio: sampleRatio}
+		return nil
+	}
+}
+
+// HollerRequestIDHeader overrides the header holler reads, generates and
+// propagates request IDs in (X-Request-ID).
+func HollerRequestIDHeader(header string) Option {
+	return func(h *HollerProxy) error {
+		if len(header) == 0 {
+			return errors.New("request ID header option can not be empty")
+		}
+		h.RequestIDHeader = http.CanonicalHeaderKey(header)
+		return nil
+	}
+}
+
+// HollerRateLimitStore shares rate limit counters between holler instances
+// through store, falling back to local limits while it is unreachable.
+func HollerRateLimitStore(store RateLimitStore) Option {
+	return func(h *HollerProxy) error {
+		if store == nil {
+			return errors.New("rate limit store option can not be nil")
+		}
+		h.limiter = newSharedLimiter(store, newLocalLimiter(), h)
+		return nil
+	}
+}
@@ -0,0 +1,295 @@
+package holler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitGlobal limits all requests to a backend together.
+	RateLimitGlobal = "global"
+	// RateLimitClient limits each client IP separately.
+	RateLimitClient = "client"
+	// RateLimitKey limits each value of RateLimit.Key separately.
+	RateLimitKey = "key"
+
+	bucketSweepInterval = time.Minute
+)
+
+// RateLimit is a token bucket refilled at Rate tokens per second holding at
+// most Burst tokens (default Rate rounded up). Key is used by the key scope
+// and is one of header:<name>, query:<name>, cookie:<name> or jwt:<claim>.
+// Requests without the key are limited by client IP instead. JWT claims are
+// read from a bearer token without verifying it, they only pick the bucket.
+type RateLimit struct {
+	Scope string  `json:"scope"`
+	Key   string  `json:"key,omitempty"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// rateLimiter takes a token from the bucket named key.
+type rateLimiter interface {
+	take(key string, limit *RateLimit) rateDecision
+}
+
+// rateDecision is the outcome of a take. refund puts an allowed token back,
+// for when another limit rejects the request.
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+	refund     func()
+}
+
+func (l *RateLimit) validate() error {
+	switch l.Scope {
+	case RateLimitGlobal, RateLimitClient:
+	case RateLimitKey:
+		kind, name := splitKey(l.Key)
+		switch kind {
+		case "header", "query", "cookie", "jwt":
+		default:
+			return errors.New("rate limit key must be header:, query:, cookie: or jwt:, got " + l.Key)
+		}
+		if len(name) == 0 {
+			return errors.New("rate limit key " + l.Key + " has no name")
+		}
+	default:
+		return errors.New("unknown rate limit scope " + l.Scope)
+	}
+	if l.Rate <= 0 {
+		return errors.New("rate limit rate must be positive")
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+	if l.Burst < 1 {
+		return errors.New("rate limit burst must be positive")
+	}
+	return nil
+}
+
+func splitKey(key string) (string, string) {
+	i := strings.Index(key, ":")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+// bucketKey returns which bucket of limit r, from client, draws from.
+func (l *RateLimit) bucketKey(r *http.Request, client string) string {
+	switch l.Scope {
+	case RateLimitGlobal:
+		return "global"
+	case RateLimitKey:
+		if value := requestKey(r, l.Key); len(value) != 0 {
+			return "key:" + value
+		}
+	}
+	return "client:" + client
+}
+
+// requestKey extracts the value named by a header:, query:, cookie: or jwt:
+// key from the request.
+func requestKey(r *http.Request, key string) string {
+	kind, name := splitKey(key)
+	switch kind {
+	case "header":
+		return r.Header.Get(name)
+	case "query":
+		return r.URL.Query().Get(name)
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+	case "jwt":
+		return jwtClaim(r, name)
+	}
+	return ""
+}
+
+// jwtClaim returns a claim from the payload of the request's bearer token.
+func jwtClaim(r *http.Request, claim string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// SetRateLimits validates and replaces the rate limits of a backend. It is
+// safe to call while the backend is serving requests.
+func (b *Backend) SetRateLimits(limits []*RateLimit) error {
+	for _, l := range limits {
+		if err := l.validate(); err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+	}
+
+	b.mu.Lock()
+	b.RateLimits = limits
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Backend) rateLimits() []*RateLimit {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.RateLimits
+}
+
+// rateLimit wraps the handler of an http backend, answering 429 once any of
+// the backend's rate limits is exhausted, without charging the others for
+// the rejected request. RateLimit-* headers describe the most constrained
+// limit.
+func (h *HollerProxy) rateLimit(inner http.Handler, b *Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := b.rateLimits()
+		if len(limits) == 0 {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		var (
+			client   = b.clientAddr(r)
+			tightest *RateLimit
+			decision rateDecision
+			taken    []rateDecision
+		)
+		for i, l := range limits {
+			key := b.NamedRoute + "|" + strconv.Itoa(i) + "|" + l.bucketKey(r, client)
+			d := h.limiter.take(key, l)
+			if tightest == nil || !d.allowed || (decision.allowed && d.remaining < decision.remaining) {
+				tightest, decision = l, d
+			}
+			if !d.allowed {
+				for _, t := range taken {
+					t.refund()
+				}
+				break
+			}
+			taken = append(taken, d)
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(tightest.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.reset)))
+
+		if !decision.allowed {
+			h.logFor(r).Debugf("backend %s rate limited %s", b.NamedRoute, client)
+			h.metrics.rateLimited.add(1, b.NamedRoute)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.retryAfter)))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// localLimiter keeps token buckets in memory.
+type localLimiter struct {
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *localLimiter) take(key string, limit *RateLimit) rateDecision {
+	now := time.Now()
+	burst := float64(limit.Burst)
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	d := rateDecision{}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+		d.refund = func() {
+			l.Lock()
+			b.tokens = math.Min(burst, b.tokens+1)
+			l.Unlock()
+		}
+	} else {
+		d.retryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = seconds((burst - b.tokens) / limit.Rate)
+	b.full = now.Add(d.reset)
+	return d
+}
+
+// sweep drops buckets that have refilled completely, as they are
+// indistinguishable from new ones.
+func (l *localLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,100 @@
+package holler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rateLimitedProxy registers a backend at /limited with limits.
+func rateLimitedProxy(t *testing.T, limits []*RateLimit, options ...Option) *HollerProxy {
+	h := newTestProxy(t, options...)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/limited", RateLimits: limits, Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// allowed counts how many of n requests from client got through.
+func allowed(h *HollerProxy, client string, n int) int {
+	ok := 0
+	for i := 0; i < n; i++ {
+		r := httptest.NewRequest("GET", "/limited", nil)
+		r.RemoteAddr = client + ":1234"
+		if serve(h, r).Code == http.StatusOK {
+			ok++
+		}
+	}
+	return ok
+}
+
+func TestRateLimitRefundsRejectedRequests(t *testing.T) {
+	h := rateLimitedProxy(t, []*RateLimit{
+		{Scope: RateLimitGlobal, Rate: 0.001, Burst: 5},
+		{Scope: RateLimitClient, Rate: 0.001, Burst: 1},
+	})
+
+	if n := allowed(h, "10.0.0.1", 3); n != 1 {
+		t.Fatalf("client limit let %d of 3 requests through, want 1", n)
+	}
+	// the two requests the client limit rejected must not have used up the
+	// global limit
+	if n := allowed(h, "10.0.0.2", 1) + allowed(h, "10.0.0.3", 1) + allowed(h, "10.0.0.4", 1) + allowed(h, "10.0.0.5", 1); n != 4 {
+		t.Errorf("global limit let %d of 4 other clients through, want 4", n)
+	}
+	if n := allowed(h, "10.0.0.6", 1); n != 0 {
+		t.Error("global limit let a sixth request through")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	h := rateLimitedProxy(t, []*RateLimit{{Scope: RateLimitClient, Rate: 1, Burst: 2}})
+
+	r := httptest.NewRequest("GET", "/limited", nil)
+	rec := serve(h, r)
+	if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("got headers %v", rec.Header())
+	}
+	serve(h, r)
+	rec = serve(h, r)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitBehindTrustedProxy(t *testing.T) {
+	h := newTestProxy(t)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	if err := h.RegisterBackend(&Backend{
+		NamedRoute:     "/limited",
+		RateLimits:     []*RateLimit{{Scope: RateLimitClient, Rate: 0.001, Burst: 1}},
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Targets:        []*Target{target},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(peer, forwardedFor string) int {
+		r := httptest.NewRequest("GET", "/limited", nil)
+		r.RemoteAddr = peer + ":1234"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		return serve(h, r).Code
+	}
+	for _, c := range []struct {
+		peer, forwardedFor string
+		want               int
+	}{
+		// clients behind the same proxy have their own buckets
+		{"10.0.0.1", "203.0.113.1", http.StatusOK},
+		{"10.0.0.1", "203.0.113.2", http.StatusOK},
+		{"10.0.0.2", "203.0.113.1", http.StatusTooManyRequests},
+		// an untrusted peer is limited by its own address whatever it sends
+		{"192.0.2.1", "203.0.113.3", http.StatusOK},
+		{"192.0.2.1", "203.0.113.4", http.StatusTooManyRequests},
+	} {
+		if code := send(c.peer, c.forwardedFor); code != c.want {
+			t.Errorf("%s for %s: got %d, want %d", c.peer, c.forwardedFor, code, c.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package holler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	storeKeyPrefix     = "holler:ratelimit:"
+	storeRetryInterval = 5 * time.Second
+
+	defaultRedisPoolSize = 8
+	defaultRedisTimeout  = 500 * time.Millisecond
+)
+
+// RateLimitStore is a counter store shared by holler instances so their rate
+// limits add up to one limit rather than one per instance.
+//
+// Incr adds one to the counter for key, creating it with a time to live of
+// window if it doesn't exist, and returns the new count and the time left
+// until the counter expires. Decr takes back an Incr whose request was
+// rejected by another limit.
+type RateLimitStore interface {
+	Incr(key string, window time.Duration) (int64, time.Duration, error)
+	Decr(key string) error
+}
+
+// sharedLimiter enforces rate limits through a RateLimitStore. Each bucket
+// becomes a fixed window of Burst/Rate seconds allowing Burst requests, which
+// gives the same long run rate as the local token bucket. While the store is
+// unreachable it falls back to the local limiter, trying the store again
+// every few seconds. It logs and counts store errors through h, read when they
+// happen so options applied later still take effect.
+type sharedLimiter struct {
+	store     RateLimitStore
+	local     rateLimiter
+	h         *HollerProxy
+	downUntil time.Time
+	sync.Mutex
+}
+
+func newSharedLimiter(store RateLimitStore, local rateLimiter, h *HollerProxy) *sharedLimiter {
+	return &sharedLimiter{
+		store: store,
+		local: local,
+		h:     h,
+	}
+}
+
+func (s *sharedLimiter) take(key string, limit *RateLimit) rateDecision {
+	s.Lock()
+	down := time.Now().Before(s.downUntil)
+	s.Unlock()
+	if down {
+		return s.local.take(key, limit)
+	}
+
+	window := seconds(float64(limit.Burst) / limit.Rate)
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+
+	count, ttl, err := s.store.Incr(storeKeyPrefix+key, window)
+	if err != nil {
+		s.Lock()
+		s.downUntil = time.Now().Add(storeRetryInterval)
+		s.Unlock()
+		s.h.Log.Warnf("rate limit store unavailable, using local limits: %s", err)
+		s.h.metrics.storeErrors.add(1)
+		return s.local.take(key, limit)
+	}
+
+	d := rateDecision{
+		allowed: count <= int64(limit.Burst),
+		reset:   ttl,
+	}
+	if d.allowed {
+		d.remaining = limit.Burst - int(count)
+		d.refund = func() {
+			if err := s.store.Decr(storeKeyPrefix + key); err != nil {
+				s.h.Log.Debugf("refunding rate limit %s: %s", key, err)
+			}
+		}
+	} else {
+		d.retryAfter = ttl
+	}
+	return d
+}
+
+// RedisConfig configures a RedisStore. Anything speaking the Redis protocol
+// and supporting INCR, DECR, DEL, PEXPIRE and PTTL will do.
+type RedisConfig struct {
+	Addr     string        `json:"addr"`
+	Password string        `json:"password,omitempty"`
+	DB       int           `json:"db,omitempty"`
+	PoolSize int           `json:"pool_size,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+}
+
+// RedisStore is a RateLimitStore backed by a Redis server, using a small pool
+// of connections.
+type RedisStore struct {
+	config RedisConfig
+	pool   chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisStore returns a store for the server at config.Addr. Connections
+// are made on first use.
+func NewRedisStore(config RedisConfig) (*RedisStore, error) {
+	if len(config.Addr) == 0 {
+		return nil, errors.New("redis address can not be empty")
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = defaultRedisPoolSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRedisTimeout
+	}
+	return &RedisStore{
+		config: config,
+		pool:   make(chan *redisConn, config.PoolSize),
+	}, nil
+}
+
+// Incr implements RateLimitStore.
+func (s *RedisStore) Incr(key string, window time.Duration) (int64, time.Duration, error) {
+	c, err := s.get()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, ttl, err := s.incr(c, key, window)
+	if err != nil {
+		c.Close()
+		return 0, 0, err
+	}
+	s.put(c)
+	return count, ttl, nil
+}
+
+// Decr implements RateLimitStore.
+func (s *RedisStore) Decr(key string) error {
+	c, err := s.get()
+	if err != nil {
+		return err
+	}
+
+	c.SetDeadline(time.Now().Add(s.config.Timeout))
+	count, err := c.doInt("DECR", key)
+	if err == nil && count < 0 {
+		// the counter expired before the refund and DECR created it again
+		// without a time to live
+		_, err = c.doInt("DEL", key)
+	}
+	if err != nil {
+		c.Close()
+		return err
+	}
+	s.put(c)
+	return nil
+}
+
+func (s *RedisStore) incr(c *redisConn, key string, window time.Duration) (int64, time.Duration, error) {
+	c.SetDeadline(time.Now().Add(s.config.Timeout))
+
+	ms := strconv.FormatInt(int64(window/time.Millisecond), 10)
+	count, err := c.doInt("INCR", key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if count == 1 {
+		if _, err := c.doInt("PEXPIRE", key, ms); err != nil {
+			return 0, 0, err
+		}
+		return 1, window, nil
+	}
+
+	ttl, err := c.doInt("PTTL", key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ttl < 0 {
+		// the expiry was lost, e.g. an instance died between INCR and
+		// PEXPIRE, so start the window over rather than block forever
+		if _, err := c.doInt("PEXPIRE", key, ms); err != nil {
+			return 0, 0, err
+		}
+		ttl = int64(window / time.Millisecond)
+	}
+	return count, time.Duration(ttl) * time.Millisecond, nil
+}
+
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.config.Addr, s.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	c.SetDeadline(time.Now().Add(s.config.Timeout))
+
+	if len(s.config.Password) != 0 {
+		if _, err := c.do("AUTH", s.config.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.config.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.config.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisStore) put(c *redisConn) {
+	select {
+	case s.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+// do sends a command and reads its reply, which is an int64, string, nil or
+// []interface{}.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed redis reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New("redis: " + body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown redis reply type %q", kind)
+}
+
+// doInt runs a command whose reply is an integer.
+func (c *redisConn) doInt(args ...string) (int64, error) {
+	reply, err := c.do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis %s replied %v, expected an integer", args[0], reply)
+	}
+	return n, nil
+}
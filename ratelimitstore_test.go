@@ -0,0 +1,285 @@
+package holler
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// fakeRedis is a minimal in-memory server speaking enough of the Redis
+// protocol for RedisStore.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	values   map[string]int64
+	expiry   map[string]time.Time
+	sync.Mutex
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: l,
+		password: password,
+		values:   make(map[string]int64),
+		expiry:   make(map[string]time.Time),
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := len(f.password) == 0
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) == 0 {
+			return
+		}
+		args := make([]string, len(values))
+		for i, v := range values {
+			args[i], _ = v.(string)
+		}
+
+		var out string
+		switch {
+		case args[0] == "AUTH":
+			authed = args[1] == f.password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		default:
+			out = f.do(args)
+		}
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) do(args []string) string {
+	f.Lock()
+	defer f.Unlock()
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if at, ok := f.expiry[key]; ok && !time.Now().Before(at) {
+			delete(f.values, key)
+			delete(f.expiry, key)
+		}
+	}
+	integer := func(n int64) string { return ":" + strconv.FormatInt(n, 10) + "\r\n" }
+
+	switch args[0] {
+	case "SELECT":
+		return "+OK\r\n"
+	case "INCR":
+		f.values[key]++
+		return integer(f.values[key])
+	case "DECR":
+		f.values[key]--
+		return integer(f.values[key])
+	case "DEL":
+		_, ok := f.values[key]
+		delete(f.values, key)
+		delete(f.expiry, key)
+		if ok {
+			return integer(1)
+		}
+		return integer(0)
+	case "PEXPIRE":
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		if _, ok := f.values[key]; !ok {
+			return integer(0)
+		}
+		f.expiry[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return integer(1)
+	case "PTTL":
+		if _, ok := f.values[key]; !ok {
+			return integer(-2)
+		}
+		at, ok := f.expiry[key]
+		if !ok {
+			return integer(-1)
+		}
+		return integer(int64(time.Until(at) / time.Millisecond))
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (f *fakeRedis) value(key string) (int64, bool) {
+	f.Lock()
+	defer f.Unlock()
+	v, ok := f.values[key]
+	return v, ok
+}
+
+func TestRedisStore(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	store, err := NewRedisStore(RedisConfig{Addr: f.addr(), Password: "secret", DB: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want := int64(1); want <= 3; want++ {
+		count, ttl, err := store.Incr("k", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want || ttl <= 0 || ttl > time.Minute {
+			t.Errorf("got count %d ttl %s, want %d within a minute", count, ttl, want)
+		}
+	}
+	if err := store.Decr("k"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := f.value("k"); v != 2 {
+		t.Errorf("got %d after a refund, want 2", v)
+	}
+
+	// a refund of an expired counter must not leave it behind without a
+	// time to live
+	if err := store.Decr("expired"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.value("expired"); ok {
+		t.Error("refunding an expired counter recreated it")
+	}
+
+	wrong, _ := NewRedisStore(RedisConfig{Addr: f.addr(), Password: "wrong"})
+	if _, _, err := wrong.Incr("k", time.Minute); err == nil {
+		t.Error("incremented with a wrong password")
+	}
+}
+
+func TestRedisStoreLostExpiry(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store, _ := NewRedisStore(RedisConfig{Addr: f.addr()})
+
+	f.Lock()
+	f.values["k"] = 5
+	f.Unlock()
+	count, ttl, err := store.Incr("k", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 || ttl != time.Second {
+		t.Errorf("got count %d ttl %s, want 6 and a new window", count, ttl)
+	}
+	f.Lock()
+	_, ok := f.expiry["k"]
+	f.Unlock()
+	if !ok {
+		t.Error("counter without expiry was not given one")
+	}
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	f := newFakeRedis(t, "")
+	limits := func() []*RateLimit {
+		return []*RateLimit{{Scope: RateLimitGlobal, Rate: 0.001, Burst: 3}}
+	}
+
+	var proxies []*HollerProxy
+	for i := 0; i < 2; i++ {
+		store, _ := NewRedisStore(RedisConfig{Addr: f.addr()})
+		proxies = append(proxies, rateLimitedProxy(t, limits(), HollerRateLimitStore(store)))
+	}
+
+	// both instances draw from the one shared bucket
+	n := allowed(proxies[0], "10.0.0.1", 2) + allowed(proxies[1], "10.0.0.2", 2) + allowed(proxies[0], "10.0.0.3", 2)
+	if n != 3 {
+		t.Errorf("instances let %d requests through together, want 3", n)
+	}
+	if v, _ := f.value(storeKeyPrefix + "/limited|0|global"); v != 6 {
+		t.Errorf("got shared count %d, want 6", v)
+	}
+}
+
+func TestSharedRateLimitRefund(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store, _ := NewRedisStore(RedisConfig{Addr: f.addr()})
+	h := rateLimitedProxy(t, []*RateLimit{
+		{Scope: RateLimitGlobal, Rate: 0.001, Burst: 5},
+		{Scope: RateLimitClient, Rate: 0.001, Burst: 1},
+	}, HollerRateLimitStore(store))
+
+	if n := allowed(h, "10.0.0.1", 3); n != 1 {
+		t.Fatalf("client limit let %d of 3 requests through, want 1", n)
+	}
+	if v, _ := f.value(storeKeyPrefix + "/limited|0|global"); v != 1 {
+		t.Errorf("got global count %d, want the rejected requests refunded", v)
+	}
+}
+
+func TestSharedRateLimitFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	store, _ := NewRedisStore(RedisConfig{Addr: addr, Timeout: 100 * time.Millisecond})
+	h := rateLimitedProxy(t, []*RateLimit{{Scope: RateLimitGlobal, Rate: 0.001, Burst: 2}}, HollerRateLimitStore(store))
+
+	// the local limits apply while the store is down
+	if n := allowed(h, "10.0.0.1", 4); n != 2 {
+		t.Errorf("let %d of 4 requests through without the store, want 2", n)
+	}
+	// the store is only retried after storeRetryInterval
+	h.metrics.storeErrors.Lock()
+	errors := h.metrics.storeErrors.get(nil).value
+	h.metrics.storeErrors.Unlock()
+	if errors != 1 {
+		t.Errorf("counted %v store errors, want 1", errors)
+	}
+}
+
+func TestSharedLimiterLogsThroughLaterLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+
+	store, _ := NewRedisStore(RedisConfig{Addr: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+	h := rateLimitedProxy(t, []*RateLimit{{Scope: RateLimitGlobal, Rate: 1}},
+		HollerRateLimitStore(store), HollerLog(logrus.NewEntry(logger)))
+
+	allowed(h, "10.0.0.1", 1)
+	if !strings.Contains(logs.String(), "rate limit store unavailable") {
+		t.Errorf("store error was not logged by the configured logger, got %q", logs.String())
+	}
+}
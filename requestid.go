@@ -0,0 +1,86 @@
+package holler
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-ID"
+	maxRequestIDLength     = 128
+)
+
+// requestContext is the per request data attached by withRequestID.
+type requestContext struct {
+	id  string
+	log *logrus.Entry
+}
+
+// withRequestID accepts the client's request ID, or generates one, sends it
+// upstream and back to the client, and attaches a logger carrying it to the
+// request context.
+func (h *HollerProxy) withRequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(h.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(h.RequestIDHeader, id)
+		}
+		w.Header().Set(h.RequestIDHeader, id)
+
+		rc := &requestContext{
+			id:  id,
+			log: h.Log.WithField("request_id", id),
+		}
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestContextKey, rc)))
+	})
+}
+
+// requestLog returns the logger for the request, which carries its request
+// ID, or log if the request has none.
+func requestLog(r *http.Request, log *logrus.Entry) *logrus.Entry {
+	if rc, ok := r.Context().Value(requestContextKey).(*requestContext); ok {
+		return rc.log
+	}
+	return log
+}
+
+// logFor returns h.Log with the request ID of r attached.
+func (h *HollerProxy) logFor(r *http.Request) *logrus.Entry {
+	return requestLog(r, h.Log)
+}
+
+// requestID returns the ID assigned to the request by withRequestID.
+func requestID(r *http.Request) string {
+	if rc, ok := r.Context().Value(requestContextKey).(*requestContext); ok {
+		return rc.id
+	}
+	return ""
+}
+
+// validRequestID accepts non-empty IDs of printable ASCII without spaces, so
+// that a client can't inject anything odd into logs or upstream headers.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random UUID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,87 @@
+package holler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// idProxy registers a backend at /ids whose target answers with the request
+// ID it got in header, and sets header on its response to an ID of its own.
+func idProxy(t *testing.T, header string, options ...Option) *HollerProxy {
+	h := newTestProxy(t, options...)
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(header, "from-upstream")
+		w.Write([]byte(r.Header.Get(header)))
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/ids", Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestRequestID(t *testing.T) {
+	h := idProxy(t, "X-Request-Id")
+
+	for _, c := range []struct {
+		name, sent string
+		kept       bool
+	}{
+		{"none", "", false},
+		{"client's", "abc-123", true},
+		{"with a space", "abc 123", false},
+		{"with a newline", "abc\n123", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+	} {
+		r := httptest.NewRequest("GET", "/ids", nil)
+		if len(c.sent) != 0 {
+			r.Header["X-Request-Id"] = []string{c.sent}
+		}
+		rec := serve(h, r)
+
+		ids := rec.Header()["X-Request-Id"]
+		if len(ids) != 1 || ids[0] != rec.Body.String() {
+			t.Errorf("%s: client got %q, upstream %q", c.name, ids, rec.Body.String())
+			continue
+		}
+		if c.kept && ids[0] != c.sent {
+			t.Errorf("%s: replaced with %q", c.name, ids[0])
+		}
+		if !c.kept && !uuidPattern.MatchString(ids[0]) {
+			t.Errorf("%s: got %q, want a generated UUID", c.name, ids[0])
+		}
+	}
+}
+
+func TestRequestIDHeaderOption(t *testing.T) {
+	h := idProxy(t, "X-Trace", HollerRequestIDHeader("x-trace"))
+	r := httptest.NewRequest("GET", "/ids", nil)
+	r.Header.Set("X-Trace", "abc")
+	rec := serve(h, r)
+	if got := rec.Header().Get("X-Trace"); got != "abc" || rec.Body.String() != "abc" {
+		t.Errorf("client got %q, upstream %q", got, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Request-Id"); len(got) != 0 {
+		t.Errorf("default header set to %q", got)
+	}
+
+	if _, err := New(HollerRequestIDHeader("")); err == nil {
+		t.Error("empty request ID header accepted")
+	}
+}
+
+func TestNewRequestIDsDiffer(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := newRequestID()
+		if seen[id] || !uuidPattern.MatchString(id) {
+			t.Fatalf("got %q after %d IDs", id, i)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,156 @@
+package holler
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule rewrites the request path with a regular expression before it
+// is joined onto the target's path. Replace may refer to capture groups as $1
+// or ${name}.
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+	re      *regexp.Regexp
+}
+
+// QueryRules add, set and remove query parameters on the upstream request.
+// Values may use the same placeholders as HeaderRules.
+type QueryRules struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+// Redirect turns a backend into a redirect-only backend. Code is one of 301,
+// 302, 307 or 308 (default 302). Location may use {scheme}, {host}, {path},
+// {query} and {request_uri}, plus capture groups from Match, which is tested
+// against the request path and defaults to matching everything. The path is
+// used as sent, still escaped, with a leading "//" collapsed to "/" so it
+// can't turn a relative location into another host.
+type Redirect struct {
+	Code     int    `json:"code,omitempty"`
+	Match    string `json:"match,omitempty"`
+	Location string `json:"location"`
+	re       *regexp.Regexp
+}
+
+// compileRewrites validates and compiles the rewrite and redirect rules of b.
+func (b *Backend) compileRewrites() error {
+	for _, rule := range b.Rewrites {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + " rewrite: " + err.Error())
+		}
+		rule.re = re
+	}
+
+	if r := b.Redirect; r != nil {
+		switch r.Code {
+		case 0:
+			r.Code = http.StatusFound
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return errors.New("backend " + b.NamedRoute + " redirect code " + strconv.Itoa(r.Code) + " not supported")
+		}
+		if len(r.Location) == 0 {
+			return errors.New("backend " + b.NamedRoute + " redirect requires a location")
+		}
+		if len(r.Match) == 0 {
+			r.Match = ".*"
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return errors.New("backend " + b.NamedRoute + " redirect: " + err.Error())
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// rewritePath returns the request path after the first matching rewrite
+// rule, and whether any rule matched.
+func (b *Backend) rewritePath(path string) (string, bool) {
+	for _, rule := range b.Rewrites {
+		if m := rule.re.FindStringSubmatchIndex(path); m != nil {
+			dst := rule.re.ExpandString(nil, rule.Replace, path, m)
+			return path[:m[0]] + string(dst) + path[m[1]:], true
+		}
+	}
+	return path, false
+}
+
+// apply rewrites the query string of the upstream request r.
+func (rules *QueryRules) apply(r *http.Request) {
+	if rules == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	for _, name := range rules.Remove {
+		query.Del(name)
+	}
+
+	expand := headerTemplate(r)
+	for name, value := range rules.Set {
+		query.Set(name, expand.Replace(value))
+	}
+	for name, value := range rules.Add {
+		query.Add(name, expand.Replace(value))
+	}
+	r.URL.RawQuery = query.Encode()
+}
+
+// ServeHTTP answers every request with the redirect, or 404 when Match
+// doesn't match the request path.
+func (r *Redirect) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.EscapedPath()
+	if strings.HasPrefix(path, "//") {
+		path = "/" + strings.TrimLeft(path, "/")
+	}
+	requestURI := path
+	if len(req.URL.RawQuery) != 0 {
+		requestURI += "?" + req.URL.RawQuery
+	}
+
+	m := r.re.FindStringSubmatchIndex(path)
+	if m == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	// placeholder values have their $ escaped, so the request can't inject
+	// capture group references into the location
+	escape := strings.NewReplacer("$", "$$")
+	location := strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", escape.Replace(req.Host),
+		"{path}", escape.Replace(path),
+		"{query}", escape.Replace(req.URL.RawQuery),
+		"{request_uri}", escape.Replace(requestURI),
+	).Replace(r.Location)
+	location = string(r.re.ExpandString(nil, location, path, m))
+
+	http.Redirect(w, req, location, r.Code)
+}
+
+// singleJoiningSlash joins a target base path and a request path, as
+// httputil.NewSingleHostReverseProxy does.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
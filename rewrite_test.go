@@ -0,0 +1,61 @@
+package holler
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectLocation(t *testing.T) {
+	b := &Backend{NamedRoute: "/old", Redirect: &Redirect{
+		Match:    "^/old/(.*)$",
+		Location: "https://new.example.com/$1?{query}",
+	}}
+	if err := b.compileRewrites(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri      string
+		location string
+	}{
+		{"/old/a/b?x=1", "https://new.example.com/a/b?x=1"},
+		// $ in the request is kept literally, not expanded as a capture group
+		{"/old/a?x=$1", "https://new.example.com/a?x=$1"},
+		{"/old/$1?x=${1}", "https://new.example.com/$1?x=${1}"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		b.Redirect.ServeHTTP(rec, httptest.NewRequest("GET", test.uri, nil))
+		if rec.Code != 302 || rec.Header().Get("Location") != test.location {
+			t.Errorf("%s: got %d %s, want %s", test.uri, rec.Code, rec.Header().Get("Location"), test.location)
+		}
+	}
+}
+
+func TestRedirectEscapedPath(t *testing.T) {
+	tests := []struct {
+		redirect Redirect
+		uri      string
+		location string
+	}{
+		// escaped ? and # stay part of the path
+		{Redirect{Location: "{path}"}, "/a%3Fb%23c", "/a%3Fb%23c"},
+		{Redirect{Location: "{request_uri}"}, "/docs/a%20b?x=1", "/docs/a%20b?x=1"},
+		{Redirect{Match: "^/old/(.*)$", Location: "https://new.example.com/$1"}, "/old/a%2Fb%3Fc", "https://new.example.com/a%2Fb%3Fc"},
+		// a leading // would make the location point at another host
+		{Redirect{Location: "{path}"}, "//evil.example/x", "/evil.example/x"},
+		{Redirect{Location: "{request_uri}"}, "///evil.example?x=1", "/evil.example?x=1"},
+		{Redirect{Match: "^/(.*)$", Location: "/$1"}, "//evil.example", "/evil.example"},
+	}
+	for _, test := range tests {
+		b := &Backend{NamedRoute: "/", Redirect: &test.redirect}
+		if err := b.compileRewrites(); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		b.Redirect.ServeHTTP(rec, httptest.NewRequest("GET", test.uri, nil))
+		if rec.Code != 302 || rec.Header().Get("Location") != test.location {
+			t.Errorf("%s with %s: got %d %s, want %s", test.uri, test.redirect.Location, rec.Code, rec.Header().Get("Location"), test.location)
+		}
+	}
+}
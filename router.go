@@ -45,12 +45,61 @@ func loadRoutes(router *mux.Router, h *HollerProxy) {
 			HandlerFunc: registerBackendHandler,
 		},
 
+		route{
+			Name:        "/register/backend/ratelimits",
+			Method:      []string{"GET", "POST"},
+			Path:        strings.Join([]string{registerPath, "backend", "ratelimits"}, "/"),
+			HandlerFunc: rateLimitsHandler,
+		},
+
+		route{
+			Name:        "/register/backend/faults",
+			Method:      []string{"GET", "POST"},
+			Path:        strings.Join([]string{registerPath, "backend", "faults"}, "/"),
+			HandlerFunc: faultsHandler,
+		},
+
+		route{
+			Name:        "/register/backend/targets",
+			Method:      []string{"GET", "POST"},
+			Path:        strings.Join([]string{registerPath, "backend", "targets"}, "/"),
+			HandlerFunc: targetsHandler,
+		},
+
+		route{
+			Name:        "/register/backend/groups",
+			Method:      []string{"GET", "POST"},
+			Path:        strings.Join([]string{registerPath, "backend", "groups"}, "/"),
+			HandlerFunc: groupsHandler,
+		},
+
+		route{
+			Name:        "/register/backend/canary",
+			Method:      []string{"GET"},
+			Path:        strings.Join([]string{registerPath, "backend", "canary"}, "/"),
+			HandlerFunc: canaryHandler,
+		},
+
+		route{
+			Name:        "/cache/purge",
+			Method:      []string{"POST", "DELETE"},
+			Path:        "/cache/purge",
+			HandlerFunc: purgeCacheHandler,
+		},
+
 		route{
 			Name:        "/registered/backends",
 			Method:      []string{"GET"},
 			Path:        "/registered/backends",
 			HandlerFunc: registeredBackendsHandler,
 		},
+
+		route{
+			Name:        "metrics",
+			Method:      []string{"GET"},
+			Path:        "/metrics",
+			HandlerFunc: metricsHandler,
+		},
 	}
 
 	for _, r := range routes {
@@ -59,6 +108,7 @@ func loadRoutes(router *mux.Router, h *HollerProxy) {
 
 		handler = r.HandlerFunc(h)
 		handler = logger(handler, r.Name, h.Log)
+		handler = h.withRequestID(handler)
 
 		router.NewRoute().
 			Path(r.Path).
@@ -78,7 +128,7 @@ func logger(inner http.Handler, name string, httpLog *logrus.Entry) http.Handler
 
 		inner.ServeHTTP(w, r)
 
-		httpLog.Printf(
+		requestLog(r, httpLog).Printf(
 			"%s\t%s\t%s\t%s",
 			r.Method,
 			r.RequestURI,
@@ -0,0 +1,259 @@
+package holler
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SelectorFirst sends everything to the first healthy target, in Targets
+	// order, and is the default.
+	SelectorFirst = "first"
+	// SelectorRandom picks a healthy target at random.
+	SelectorRandom = "random"
+	// SelectorRoundRobin cycles through the healthy targets.
+	SelectorRoundRobin = "roundrobin"
+	// SelectorRingHash maps requests onto a consistent hash ring.
+	SelectorRingHash = "ring_hash"
+	// SelectorMaglev maps requests through a Maglev lookup table.
+	SelectorMaglev = "maglev"
+	// SelectorLeastConn picks the target with the fewest active requests.
+	SelectorLeastConn = "leastconn"
+	// SelectorPeakEWMA picks the target with the lowest expected latency.
+	SelectorPeakEWMA = "peak_ewma"
+)
+
+var errNoHealthyTargets = errors.New("no healthy targets")
+
+// selection is what a targetSelector picks from: candidates are the healthy
+// targets the request may go to, in Targets order, and are never empty.
+// targets are all of the backend's targets. r is nil outside of http.
+type selection struct {
+	targets    []*Target
+	candidates []*Target
+	r          *http.Request
+	client     string
+}
+
+// targetSelector picks one of the candidates of a selection.
+type targetSelector interface {
+	pick(s *selection) *Target
+}
+
+func newTargetSelector(b *Backend) (targetSelector, error) {
+	name := b.TargetSelector
+	switch name {
+	case "", SelectorFirst:
+		return firstSelector{}, nil
+	case SelectorRandom:
+		return randomSelector{}, nil
+	case SelectorRoundRobin:
+		return &roundRobinSelector{}, nil
+	case SelectorLeastConn:
+		return leastConnSelector{}, nil
+	case SelectorPeakEWMA:
+		if !b.isHTTP() {
+			return nil, errors.New("target selector " + name + " requires an http backend")
+		}
+		if b.EWMA == nil {
+			b.EWMA = &EWMAConfig{}
+		}
+		if err := b.EWMA.validate(); err != nil {
+			return nil, err
+		}
+		return &peakEWMASelector{config: b.EWMA}, nil
+	case SelectorRingHash, SelectorMaglev:
+		if b.Hashing == nil {
+			b.Hashing = &HashConfig{}
+		}
+		if err := b.Hashing.validate(name); err != nil {
+			return nil, err
+		}
+		return &hashSelector{config: b.Hashing, maglev: name == SelectorMaglev}, nil
+	}
+	return nil, errors.New("unknown target selector " + name)
+}
+
+type firstSelector struct{}
+
+func (firstSelector) pick(s *selection) *Target {
+	return s.candidates[0]
+}
+
+type randomSelector struct{}
+
+func (randomSelector) pick(s *selection) *Target {
+	return s.candidates[rand.Intn(len(s.candidates))]
+}
+
+type roundRobinSelector struct {
+	next uint64
+}
+
+func (rr *roundRobinSelector) pick(s *selection) *Target {
+	n := atomic.AddUint64(&rr.next, 1) - 1
+	return s.candidates[n%uint64(len(s.candidates))]
+}
+
+// leastConnSelector picks the candidate with the fewest active requests,
+// breaking ties at random.
+type leastConnSelector struct{}
+
+func (leastConnSelector) pick(s *selection) *Target {
+	var (
+		n     = len(s.candidates)
+		start = rand.Intn(n)
+		best  *Target
+		least int64
+	)
+	for i := 0; i < n; i++ {
+		t := s.candidates[(start+i)%n]
+		if active := atomic.LoadInt64(&t.active); best == nil || active < least {
+			best, least = t, active
+		}
+	}
+	return best
+}
+
+// hashing reports whether the backend selects targets by consistent hashing,
+// which lays targets out by their weight instead of weighing candidates.
+func (b *Backend) hashing() bool {
+	return b.TargetSelector == SelectorRingHash || b.TargetSelector == SelectorMaglev
+}
+
+// configureSelection sets up the target selector, affinity, failover, slow
+// start and target groups of a backend.
+func (b *Backend) configureSelection() error {
+	selector, err := newTargetSelector(b)
+	if err != nil {
+		return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+	}
+	b.selector = selector
+
+	if b.Affinity != nil {
+		if err := b.Affinity.validate(b.isHTTP()); err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+	}
+	if b.Failover != nil {
+		if err := b.Failover.validate(); err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+	}
+	if b.SlowStart != nil {
+		if err := b.SlowStart.validate(b.TargetSelector); err != nil {
+			return errors.New("backend " + b.NamedRoute + ": " + err.Error())
+		}
+	}
+	if err := b.configureGroups(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, t := range b.allTargets() {
+		if t.healthy() {
+			t.warm(now)
+		}
+	}
+	return nil
+}
+
+// SelectHealthy chooses a healthy target with the backend's target selector.
+func (b *Backend) SelectHealthy() (*Target, error) {
+	return b.selectTarget(nil, "", nil)
+}
+
+// selectTarget chooses a target for a request r, nil outside of http, from
+// the client IP, among the healthy targets of the tiers that take traffic. A
+// target the request has affinity to wins over the target selector, which
+// picks from candidates weighed by their Weight and slow start window, unless
+// it weighs targets itself. Targets eligible rejects are skipped.
+func (b *Backend) selectTarget(r *http.Request, client string, eligible func(*Target) bool) (*Target, error) {
+	s := &selection{targets: b.targets(), r: r, client: client}
+	selector := b.selector
+	if len(b.Groups) != 0 {
+		group := b.pickGroup(r, client, eligible)
+		if group == nil {
+			return nil, errNoHealthyTargets
+		}
+		s.targets, selector = group.Targets, group.selector
+	}
+
+	s.candidates = b.candidates(s.targets, eligible)
+	if len(s.candidates) == 0 {
+		return nil, errNoHealthyTargets
+	}
+
+	if t := b.affinityTarget(r, client, s.candidates); t != nil {
+		return t, nil
+	}
+
+	if !b.hashing() {
+		s.candidates = b.weigh(s.candidates)
+	}
+	if selector == nil {
+		selector = firstSelector{}
+	}
+	return selector.pick(s), nil
+}
+
+// weigh keeps the k heaviest candidates, by their effective weight, drawing k
+// so that selecting evenly among those kept gives each candidate a share of
+// requests proportional to its weight.
+func (b *Backend) weigh(candidates []*Target) []*Target {
+	var (
+		now     = time.Now()
+		weights = make([]float64, len(candidates))
+		order   = make([]int, len(candidates))
+		total   float64
+	)
+	for i, t := range candidates {
+		weights[i] = b.effectiveWeight(t, now)
+		order[i] = i
+		total += weights[i]
+	}
+	sort.SliceStable(order, func(i, j int) bool { return weights[order[i]] > weights[order[j]] })
+	if weights[order[0]] == weights[order[len(order)-1]] {
+		return candidates
+	}
+
+	// the k heaviest are kept with a probability of k times the gap between
+	// the k-th and the next weight, over the total
+	k, r := len(order), rand.Float64()*total
+	for i := range order {
+		next := 0.0
+		if i+1 < len(order) {
+			next = weights[order[i+1]]
+		}
+		if r -= float64(i+1) * (weights[order[i]] - next); r < 0 {
+			k = i + 1
+			break
+		}
+	}
+
+	keep := make([]bool, len(candidates))
+	for _, i := range order[:k] {
+		keep[i] = true
+	}
+	kept := make([]*Target, 0, k)
+	for i, t := range candidates {
+		if keep[i] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// effectiveWeight is the weight of a target at now, scaled down during its
+// slow start window.
+func (b *Backend) effectiveWeight(t *Target, now time.Time) float64 {
+	w := float64(t.weight())
+	if b.SlowStart != nil {
+		w *= b.SlowStart.weight(atomic.LoadInt64(&t.healthySince), now)
+	}
+	return w
+}
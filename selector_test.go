@@ -0,0 +1,36 @@
+package holler
+
+import "testing"
+
+func TestPeakEWMARequiresHTTP(t *testing.T) {
+	for _, kind := range []string{KindTCP, KindTLS, KindUDP} {
+		b := &Backend{NamedRoute: "/l4", Kind: kind, TargetSelector: SelectorPeakEWMA}
+		if _, err := newTargetSelector(b); err == nil {
+			t.Errorf("%s backend accepted peak_ewma", kind)
+		}
+	}
+	b := &Backend{NamedRoute: "/http", Kind: KindHTTP, TargetSelector: SelectorPeakEWMA}
+	if _, err := newTargetSelector(b); err != nil {
+		t.Errorf("http backend rejected peak_ewma: %s", err)
+	}
+}
+
+func TestLeastConnSelector(t *testing.T) {
+	busy, idle, other := &Target{URL: "busy", active: 3}, &Target{URL: "idle", active: 1}, &Target{URL: "other", active: 2}
+	candidates := []*Target{busy, idle, other}
+	for i := 0; i < 20; i++ {
+		if got := (leastConnSelector{}).pick(&selection{targets: candidates, candidates: candidates}); got != idle {
+			t.Fatalf("picked %s with %d active", got.URL, got.active)
+		}
+	}
+
+	// ties are broken at random rather than always going to the first
+	idle.active, other.active = 2, 2
+	picked := map[*Target]bool{}
+	for i := 0; i < 100; i++ {
+		picked[(leastConnSelector{}).pick(&selection{targets: candidates, candidates: candidates})] = true
+	}
+	if picked[busy] || !picked[idle] || !picked[other] {
+		t.Errorf("tied targets picked as %v", picked)
+	}
+}
@@ -0,0 +1,55 @@
+package holler
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSlowStartMinPercent = 10
+
+// SlowStartConfig ramps up the traffic of targets that were just registered
+// or recovered. Over Window seconds a target's effective weight grows
+// linearly from MinPercent (default 10) to its full share of new requests.
+// Clients with affinity to the target keep going to it. The hashing selectors
+// keep keys on their target and can't ramp one up, so they don't support it.
+type SlowStartConfig struct {
+	Window     int `json:"window"`
+	MinPercent int `json:"min_percent,omitempty"`
+}
+
+func (c *SlowStartConfig) validate(selector string) error {
+	if selector == SelectorRingHash || selector == SelectorMaglev {
+		return errors.New("slow start is not supported by the " + selector + " selector")
+	}
+	if c.Window <= 0 {
+		return errors.New("slow start window must be above 0")
+	}
+	if c.MinPercent < 0 || c.MinPercent > 100 {
+		return errors.New("slow start min_percent must be between 0 and 100")
+	}
+	if c.MinPercent == 0 {
+		c.MinPercent = defaultSlowStartMinPercent
+	}
+	return nil
+}
+
+// weight returns the share of its traffic a target healthy since the given
+// unix nanoseconds gets at now, between MinPercent/100 and 1.
+func (c *SlowStartConfig) weight(since int64, now time.Time) float64 {
+	elapsed := now.Sub(time.Unix(0, since))
+	window := time.Duration(c.Window) * time.Second
+	if since == 0 || elapsed >= window {
+		return 1
+	}
+	min := float64(c.MinPercent) / 100
+	if elapsed < 0 {
+		return min
+	}
+	return min + (1-min)*float64(elapsed)/float64(window)
+}
+
+// warm starts the slow start window of a target that became healthy.
+func (t *Target) warm(now time.Time) {
+	atomic.StoreInt64(&t.healthySince, now.UnixNano())
+}
@@ -0,0 +1,93 @@
+package holler
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSlowStartWeight(t *testing.T) {
+	c := &SlowStartConfig{Window: 10, MinPercent: 20}
+	now := time.Now()
+	at := func(ago time.Duration) int64 { return now.Add(-ago).UnixNano() }
+
+	for _, w := range []struct {
+		name  string
+		since int64
+		want  float64
+	}{
+		{"never warmed", 0, 1},
+		{"just healthy", at(0), 0.2},
+		{"a quarter in", at(2500 * time.Millisecond), 0.4},
+		{"halfway", at(5 * time.Second), 0.6},
+		{"window over", at(10 * time.Second), 1},
+		{"long healthy", at(time.Hour), 1},
+		{"clock behind", at(-time.Second), 0.2},
+	} {
+		if got := c.weight(w.since, now); math.Abs(got-w.want) > 1e-9 {
+			t.Errorf("%s: got %.3f, want %.3f", w.name, got, w.want)
+		}
+	}
+}
+
+func TestSlowStartValidate(t *testing.T) {
+	for _, c := range []struct {
+		selector string
+		config   SlowStartConfig
+	}{
+		{SelectorRingHash, SlowStartConfig{Window: 10}},
+		{SelectorMaglev, SlowStartConfig{Window: 10}},
+		{SelectorRandom, SlowStartConfig{}},
+		{SelectorRandom, SlowStartConfig{Window: 10, MinPercent: 101}},
+	} {
+		if err := c.config.validate(c.selector); err == nil {
+			t.Errorf("%s %+v: validated", c.selector, c.config)
+		}
+	}
+	c := &SlowStartConfig{Window: 10}
+	if err := c.validate(SelectorRoundRobin); err != nil || c.MinPercent != defaultSlowStartMinPercent {
+		t.Errorf("got %v and min_percent %d, want the default", err, c.MinPercent)
+	}
+}
+
+// warmingShare selects n times between a target that has long been healthy
+// and one that became healthy ago, and returns the share of the latter.
+func warmingShare(t *testing.T, ago time.Duration, n int) float64 {
+	old, warming := &Target{URL: "http://old", Healthy: true}, &Target{URL: "http://warming", Healthy: true}
+	b := &Backend{
+		NamedRoute:     "/slow",
+		Kind:           KindHTTP,
+		TargetSelector: SelectorRandom,
+		SlowStart:      &SlowStartConfig{Window: 10},
+		Targets:        []*Target{old, warming},
+	}
+	if err := b.configureSelection(); err != nil {
+		t.Fatal(err)
+	}
+	old.healthySince = 0
+	warming.warm(time.Now().Add(-ago))
+
+	picked := 0
+	for i := 0; i < n; i++ {
+		if target, _ := b.selectTarget(nil, "", nil); target == warming {
+			picked++
+		}
+	}
+	return float64(picked) / float64(n)
+}
+
+func TestSlowStartShare(t *testing.T) {
+	// effective weights 1 and 0.1, then 1 and 0.55 halfway through
+	for _, c := range []struct {
+		ago  time.Duration
+		want float64
+	}{
+		{0, 0.1 / 1.1},
+		{5 * time.Second, 0.55 / 1.55},
+		{10 * time.Second, 0.5},
+	} {
+		if share := warmingShare(t, c.ago, 20000); math.Abs(share-c.want) > 0.02 {
+			t.Errorf("%s in: warming target got %.3f of new requests, want %.3f", c.ago, share, c.want)
+		}
+	}
+}
@@ -1,8 +1,129 @@
 package holler
 
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
 // Target type abstracts a backend destination
 type Target struct {
-	URL         string `json:"url"`
-	Healthy     bool   `json:"health,omitempty"`
-	HealthRoute string `json:"health_route,omitempty"`
+	// inFlight, active and healthySince are first to keep them 64-bit aligned
+	// for sync/atomic. inFlight counts requests admitted by the concurrency
+	// limiter, active the upstream requests or connections open to the target.
+	// healthySince is when the target last became healthy, in unix
+	// nanoseconds, for slow start. health is set by health checks, zero
+	// meaning the target still has the Healthy it was configured with.
+	inFlight     int64
+	active       int64
+	healthySince int64
+	health       int32
+	URL          string `json:"url"`
+	Healthy      bool   `json:"health,omitempty"`
+	HealthRoute  string `json:"health_route,omitempty"`
+	// Priority is the target's failover tier, lower tiers are used first
+	Priority int `json:"priority,omitempty"`
+	// Weight scales the target's share of requests against the others,
+	// targets without one weigh 1
+	Weight int `json:"weight,omitempty"`
+
+	latency latencyEWMA
+}
+
+// SetTargets replaces the targets of a backend. Targets whose URL is already
+// present are kept as they are, with their health and load, so selectors only
+// move requests off removed targets and onto added ones. Healthy added targets
+// start their slow start window. A target whose Priority or Weight changed is
+// replaced by the new one, which takes over its health, as selectors read
+// targets without locking. Removed and replaced targets are marked unhealthy,
+// moving sessions still pinned to them.
+func (b *Backend) SetTargets(targets []*Target) error {
+	if len(b.Groups) != 0 {
+		return errors.New("backend " + b.NamedRoute + " uses target groups")
+	}
+	for _, t := range targets {
+		if _, err := url.Parse(t.URL); err != nil || len(t.URL) == 0 {
+			return errors.New("backend " + b.NamedRoute + ": invalid target url " + t.URL)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existing := make(map[string]*Target, len(b.Targets))
+	for _, t := range b.Targets {
+		existing[t.URL] = t
+	}
+
+	now := time.Now()
+	next := make([]*Target, 0, len(targets))
+	for _, t := range targets {
+		old, ok := existing[t.URL]
+		switch {
+		case ok && old.Priority == t.Priority && old.Weight == t.Weight:
+			delete(existing, t.URL)
+			t = old
+		case ok:
+			t.setHealthy(old.healthy())
+			atomic.StoreInt64(&t.healthySince, atomic.LoadInt64(&old.healthySince))
+		case t.healthy():
+			t.warm(now)
+		}
+		next = append(next, t)
+	}
+	for _, t := range existing {
+		t.setHealthy(false)
+	}
+	b.Targets = next
+	return nil
+}
+
+const (
+	targetUp   = 1
+	targetDown = 2
+)
+
+// healthy reports whether the target is healthy. Read it instead of Healthy,
+// which is only the health a target starts with.
+func (t *Target) healthy() bool {
+	switch atomic.LoadInt32(&t.health) {
+	case targetUp:
+		return true
+	case targetDown:
+		return false
+	}
+	return t.Healthy
+}
+
+// setHealthy records the target's health.
+func (t *Target) setHealthy(healthy bool) {
+	health := int32(targetDown)
+	if healthy {
+		health = targetUp
+	}
+	atomic.StoreInt32(&t.health, health)
+}
+
+// MarshalJSON reports the target's current health as health.
+func (t *Target) MarshalJSON() ([]byte, error) {
+	type target Target
+	return json.Marshal(struct {
+		*target
+		Healthy bool `json:"health,omitempty"`
+	}{(*target)(t), t.healthy()})
+}
+
+func (t *Target) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+func (b *Backend) targets() []*Target {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Targets
 }
@@ -0,0 +1,427 @@
+package holler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+
+	// SpanServer, SpanClient and SpanInternal are the kinds of Span holler
+	// emits, matching the OpenTelemetry span kinds.
+	SpanServer   = "server"
+	SpanClient   = "client"
+	SpanInternal = "internal"
+
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// TracingConfig configures W3C Trace Context propagation and span export.
+// Endpoint is an OTLP/HTTP traces URL such as
+// http://collector:4318/v1/traces. SampleRatio (default 1) applies to
+// requests arriving without a sampled parent and can be overridden per
+// backend.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	ServiceName string            `json:"service_name,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	SampleRatio *float64          `json:"sample_ratio,omitempty"`
+}
+
+// Span is a finished unit of work in a trace. IDs are lower case hex.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	TraceState   string
+	Name         string
+	Kind         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Error        string
+	sampled      bool
+}
+
+// SpanExporter receives every sampled span once it has ended.
+type SpanExporter interface {
+	ExportSpan(*Span)
+}
+
+type tracer struct {
+	exporter    SpanExporter
+	sampleRatio float64
+}
+
+// startTrace continues the trace in the request's traceparent header, or
+// starts a new one, and returns the server span for the proxy hop. Routes are
+// matched by the mux before a backend's handler runs, so there is no separate
+// route match span: the server span starts once the route matched and names
+// it in http.route.
+func (t *tracer) startTrace(r *http.Request, b *Backend) *Span {
+	span := &Span{
+		Name:       "proxy " + b.NamedRoute,
+		Kind:       SpanServer,
+		Start:      time.Now(),
+		SpanID:     newSpanID(),
+		Attributes: map[string]string{},
+	}
+
+	traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+	if ok {
+		span.TraceID, span.ParentSpanID, span.sampled = traceID, parentID, sampled
+		span.TraceState = r.Header.Get(tracestateHeader)
+	} else {
+		span.TraceID = newTraceID()
+		span.sampled = sampleTrace(span.TraceID, b.traceSampleRatio(t.sampleRatio))
+	}
+
+	span.Attributes["http.method"] = r.Method
+	span.Attributes["http.target"] = r.URL.RequestURI()
+	span.Attributes["http.route"] = b.NamedRoute
+	span.Attributes["net.peer.ip"] = clientIP(r)
+	return span
+}
+
+// child starts a span under parent.
+func (t *tracer) child(parent *Span, name, kind string) *Span {
+	return &Span{
+		TraceID:      parent.TraceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: parent.SpanID,
+		TraceState:   parent.TraceState,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+		Attributes:   map[string]string{},
+		sampled:      parent.sampled,
+	}
+}
+
+// end finishes a span and hands it to the exporter if its trace is sampled.
+// A nil tracer or span is a no-op, so call sites don't need to check whether
+// tracing is enabled.
+func (t *tracer) end(span *Span) {
+	if t == nil || span == nil {
+		return
+	}
+	span.End = time.Now()
+	if span.sampled {
+		t.exporter.ExportSpan(span)
+	}
+}
+
+// traceparent formats the header sent upstream, naming span as the parent.
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceID + "-" + s.SpanID + "-" + flags
+}
+
+// setError records err on the span.
+func (s *Span) setError(err error) {
+	if s != nil && err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(header string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false, false
+	}
+	traceID, parentID = parts[1], parts[2]
+	if len(traceID) != 32 || !isLowerHex(traceID) || traceID == strings.Repeat("0", 32) {
+		return "", "", false, false
+	}
+	if len(parentID) != 16 || !isLowerHex(parentID) || parentID == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleTrace makes a deterministic sampling decision from the trace ID, so
+// every holler instance agrees on the same trace.
+func sampleTrace(traceID string, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	id, err := hex.DecodeString(traceID[16:])
+	if err != nil {
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(id)>>11) < ratio*(1<<53)
+}
+
+func newTraceID() string { return randomHex(16) }
+func newSpanID() string  { return randomHex(8) }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceSampleRatio returns the backend's sample ratio, or def if it has none.
+func (b *Backend) traceSampleRatio(def float64) float64 {
+	if b.TraceSampleRatio != nil {
+		return *b.TraceSampleRatio
+	}
+	return def
+}
+
+// InMemoryExporter keeps exported spans in memory, for tests.
+type InMemoryExporter struct {
+	spans []Span
+	sync.Mutex
+}
+
+// ExportSpan implements SpanExporter.
+func (e *InMemoryExporter) ExportSpan(s *Span) {
+	e.Lock()
+	e.spans = append(e.spans, *s)
+	e.Unlock()
+}
+
+// Spans returns a copy of every span exported so far.
+func (e *InMemoryExporter) Spans() []Span {
+	e.Lock()
+	defer e.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// Reset drops all exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.Lock()
+	e.spans = nil
+	e.Unlock()
+}
+
+// OTLPExporter batches spans and posts them to an OpenTelemetry collector
+// using OTLP/HTTP with JSON encoding. Spans are dropped when the queue is full
+// rather than slowing down proxied requests.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+	queue       chan *Span
+	flush       chan chan error
+	log         *logrus.Entry
+}
+
+// NewOTLPExporter starts an exporter posting to config.Endpoint.
+func NewOTLPExporter(config TracingConfig) (*OTLPExporter, error) {
+	if len(config.Endpoint) == 0 {
+		return nil, errors.New("tracing endpoint can not be empty")
+	}
+	if len(config.ServiceName) == 0 {
+		config.ServiceName = "holler"
+	}
+
+	e := &OTLPExporter{
+		endpoint:    config.Endpoint,
+		serviceName: config.ServiceName,
+		headers:     config.Headers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, otlpQueueSize),
+		flush:       make(chan chan error),
+		log:         logrus.WithFields(logrus.Fields{"holler": "tracing"}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// ExportSpan implements SpanExporter.
+func (e *OTLPExporter) ExportSpan(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.log.Debug("span queue full, dropping span")
+	}
+}
+
+// Flush sends any queued spans immediately.
+func (e *OTLPExporter) Flush() error {
+	done := make(chan error)
+	e.flush <- done
+	return <-done
+}
+
+func (e *OTLPExporter) run() {
+	var (
+		batch  []*Span
+		ticker = time.NewTicker(otlpFlushInterval)
+	)
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := e.post(batch)
+		if err != nil {
+			e.log.Warnf("exporting %d spans: %s", len(batch), err)
+		}
+		batch = nil
+		return err
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					drained = true
+				}
+			}
+			done <- send()
+		}
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func keyValues(attributes map[string]string) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+	for k, v := range attributes {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+func (e *OTLPExporter) post(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			TraceState:        s.TraceState,
+			Name:              s.Name,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        keyValues(s.Attributes),
+		}
+		switch s.Kind {
+		case SpanServer:
+			o.Kind = 2
+		case SpanClient:
+			o.Kind = 3
+		default:
+			o.Kind = 1
+		}
+		if len(s.Error) != 0 {
+			o.Status.Code, o.Status.Message = 2, s.Error
+		}
+		spans = append(spans, o)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": keyValues(map[string]string{"service.name": e.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "holler"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector returned " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package holler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		sampled bool
+		ok      bool
+	}{
+		{"00-" + testTraceID + "-" + testParentID + "-01", true, true},
+		{"00-" + testTraceID + "-" + testParentID + "-00", false, true},
+		{"01-" + testTraceID + "-" + testParentID + "-01-future", true, true},
+		{"00-" + testTraceID + "-" + testParentID + "-01-extra", false, false},
+		{"ff-" + testTraceID + "-" + testParentID + "-01", false, false},
+		{"00-00000000000000000000000000000000-" + testParentID + "-01", false, false},
+		{"00-" + testTraceID + "-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testParentID + "-01", false, false},
+		{"00-" + testTraceID + "-" + testParentID + "-1", false, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		traceID, parentID, sampled, ok := parseTraceparent(test.header)
+		if ok != test.ok || sampled != test.sampled {
+			t.Errorf("%q: got sampled %v ok %v, want %v %v", test.header, sampled, ok, test.sampled, test.ok)
+		}
+		if ok && (traceID != testTraceID || parentID != testParentID) {
+			t.Errorf("%q: got trace %s parent %s", test.header, traceID, parentID)
+		}
+	}
+}
+
+func TestSampleTrace(t *testing.T) {
+	if !sampleTrace(testTraceID, 1) || sampleTrace(testTraceID, 0) {
+		t.Fatal("ratios 1 and 0 must sample everything and nothing")
+	}
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		id := newTraceID()
+		if sampleTrace(id, 0.5) != sampleTrace(id, 0.5) {
+			t.Fatal("sampling is not deterministic")
+		}
+		if sampleTrace(id, 0.5) {
+			sampled++
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("sampled %d of 1000 traces at ratio 0.5", sampled)
+	}
+}
+
+func TestTracingDefaultSampleRatio(t *testing.T) {
+	h := newTestProxy(t, HollerTracing(TracingConfig{Endpoint: "http://127.0.0.1:1/v1/traces"}))
+	if h.tracer.sampleRatio != 1 {
+		t.Errorf("got sample ratio %v, want 1", h.tracer.sampleRatio)
+	}
+
+	zero := 0.0
+	h = newTestProxy(t, HollerTracing(TracingConfig{Endpoint: "http://127.0.0.1:1/v1/traces", SampleRatio: &zero}))
+	if h.tracer.sampleRatio != 0 {
+		t.Errorf("got sample ratio %v, want 0", h.tracer.sampleRatio)
+	}
+}
+
+// tracedProxy registers a backend at /traced whose upstream records the
+// traceparent it receives.
+func tracedProxy(t *testing.T, sampleRatio float64) (*HollerProxy, *InMemoryExporter, *string) {
+	exporter := &InMemoryExporter{}
+	h := newTestProxy(t, HollerTraceExporter(exporter, sampleRatio))
+
+	var received string
+	target := upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(traceparentHeader)
+	})
+	if err := h.RegisterBackend(&Backend{NamedRoute: "/traced", Targets: []*Target{target}}); err != nil {
+		t.Fatal(err)
+	}
+	return h, exporter, &received
+}
+
+func TestTracePropagation(t *testing.T) {
+	h, exporter, received := tracedProxy(t, 0)
+
+	r := httptest.NewRequest("GET", "/traced", nil)
+	r.Header.Set(traceparentHeader, "00-"+testTraceID+"-"+testParentID+"-01")
+	r.Header.Set(tracestateHeader, "vendor=value")
+	serve(h, r)
+
+	spans := map[string]Span{}
+	for _, span := range exporter.Spans() {
+		if span.TraceID != testTraceID || span.TraceState != "vendor=value" {
+			t.Errorf("span %s has trace %s state %q", span.Name, span.TraceID, span.TraceState)
+		}
+		spans[span.Name] = span
+	}
+	if len(spans) != 3 {
+		t.Fatalf("got spans %v, want proxy, select target and upstream", spans)
+	}
+
+	server, selection, client := spans["proxy /traced"], spans["select target"], spans["upstream GET"]
+	if server.Kind != SpanServer || server.ParentSpanID != testParentID {
+		t.Errorf("server span %+v does not continue the incoming trace", server)
+	}
+	if route := server.Attributes["http.route"]; route != "/traced" {
+		t.Errorf("server span names route %q, want /traced", route)
+	}
+	if selection.ParentSpanID != server.SpanID || client.ParentSpanID != server.SpanID {
+		t.Error("child spans are not parented to the server span")
+	}
+	if client.Kind != SpanClient || client.Attributes["http.status_code"] != "200" {
+		t.Errorf("upstream span %+v", client)
+	}
+	if want := "00-" + testTraceID + "-" + client.SpanID + "-01"; *received != want {
+		t.Errorf("upstream got traceparent %q, want %q", *received, want)
+	}
+}
+
+func TestTraceUnsampledParent(t *testing.T) {
+	h, exporter, received := tracedProxy(t, 1)
+
+	r := httptest.NewRequest("GET", "/traced", nil)
+	r.Header.Set(traceparentHeader, "00-"+testTraceID+"-"+testParentID+"-00")
+	serve(h, r)
+
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("exported %d spans of an unsampled trace", len(spans))
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(*received)
+	if !ok || sampled || traceID != testTraceID || parentID == testParentID {
+		t.Errorf("upstream got traceparent %q", *received)
+	}
+}
+
+func TestTraceNewRoot(t *testing.T) {
+	h, exporter, received := tracedProxy(t, 1)
+	serve(h, httptest.NewRequest("GET", "/traced", nil))
+
+	spans := exporter.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	traceID, _, sampled, ok := parseTraceparent(*received)
+	if !ok || !sampled || traceID != spans[0].TraceID {
+		t.Errorf("upstream got traceparent %q for trace %s", *received, spans[0].TraceID)
+	}
+
+	ratio := 0.0
+	h.Backends["/traced"].TraceSampleRatio = &ratio
+	exporter.Reset()
+	serve(h, httptest.NewRequest("GET", "/traced", nil))
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("exported %d spans with a backend sample ratio of 0", len(spans))
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(TracingConfig{
+		Endpoint:    collector.URL,
+		ServiceName: "edge",
+		Headers:     map[string]string{"Authorization": "token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.ExportSpan(&Span{
+		TraceID:      testTraceID,
+		SpanID:       "b7ad6b7169203331",
+		ParentSpanID: testParentID,
+		Name:         "upstream GET",
+		Kind:         SpanClient,
+		Attributes:   map[string]string{"http.status_code": "502"},
+		Error:        "502 Bad Gateway",
+	})
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(<-bodies, &payload); err != nil {
+		t.Fatal(err)
+	}
+	resource := payload.ResourceSpans[0]
+	if service := resource.Resource.Attributes[0]; service.Key != "service.name" || service.Value.StringValue != "edge" {
+		t.Errorf("got resource attribute %+v", service)
+	}
+	span := resource.ScopeSpans[0].Spans[0]
+	if span.TraceID != testTraceID || span.ParentSpanID != testParentID || span.Kind != 3 {
+		t.Errorf("got span %+v", span)
+	}
+	if span.Status.Code != 2 || span.Status.Message != "502 Bad Gateway" {
+		t.Errorf("got status %+v", span.Status)
+	}
+}
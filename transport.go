@@ -0,0 +1,102 @@
+package holler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamTransport sends the requests of an http backend to its targets,
+// recording upstream latency, active requests and the connections the
+// underlying transport retried.
+type upstreamTransport struct {
+	http.RoundTripper
+	h       *HollerProxy
+	backend *Backend
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state := proxyStateFrom(req)
+	start := time.Now()
+	defer func() { state.upstream = time.Since(start) }()
+
+	// http.Transport gets a new connection for each attempt when it retries
+	// an idempotent request on a connection that went away
+	var conns int32
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GetConn: func(string) { atomic.AddInt32(&conns, 1) },
+	}))
+	defer func() {
+		if n := atomic.LoadInt32(&conns); n > 1 {
+			t.h.metrics.retries.add(float64(n-1), t.backend.NamedRoute)
+		}
+	}()
+
+	return t.roundTrip(req, state)
+}
+
+// roundTrip makes a single upstream attempt, counted as active on its target
+// until the response body is closed. The time to its response headers is
+// the target's observed latency.
+func (t *upstreamTransport) roundTrip(req *http.Request, state *proxyState) (*http.Response, error) {
+	target := state.target
+	if target == nil {
+		return t.send(req, state)
+	}
+
+	atomic.AddInt64(&target.active, 1)
+	start := time.Now()
+	resp, err := t.send(req, state)
+	t.backend.observeLatency(target, time.Since(start), err != nil)
+	if err != nil {
+		atomic.AddInt64(&target.active, -1)
+		return resp, err
+	}
+	resp.Body = &activeBody{ReadCloser: resp.Body, target: target}
+	return resp, nil
+}
+
+// activeBody releases its target's active count once closed.
+type activeBody struct {
+	io.ReadCloser
+	target *Target
+	closed int32
+}
+
+func (b *activeBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		atomic.AddInt64(&b.target.active, -1)
+	}
+	return b.ReadCloser.Close()
+}
+
+// send makes an upstream request, traced as a client span whose ID is sent
+// upstream as the traceparent parent.
+func (t *upstreamTransport) send(req *http.Request, state *proxyState) (*http.Response, error) {
+	if state.span == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	span := t.h.tracer.child(state.span, "upstream "+req.Method, SpanClient)
+	span.Attributes["http.url"] = req.URL.String()
+	span.Attributes["holler.target"] = state.targetURL()
+
+	req = req.Clone(req.Context())
+	req.Header.Set(traceparentHeader, span.traceparent())
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		span.setError(err)
+	} else {
+		span.Attributes["http.status_code"] = strconv.Itoa(resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			span.Error = resp.Status
+		}
+	}
+	t.h.tracer.end(span)
+
+	return resp, err
+}
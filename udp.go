@@ -0,0 +1,224 @@
+package holler
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultUDPSessionTimeout = 30
+	udpMaxDatagram           = 64 * 1024
+)
+
+// udpListener relays datagrams for a single udp backend. Each client address
+// gets its own session, pinned to one target, with its own upstream socket so
+// replies can be matched back to the client.
+type udpListener struct {
+	backend  *Backend
+	conn     net.PacketConn
+	timeout  time.Duration
+	log      *logrus.Entry
+	metrics  *hollerMetrics
+	sessions map[string]*udpSession
+	sync.Mutex
+}
+
+type udpSession struct {
+	client   net.Addr
+	target   *Target
+	upstream *net.UDPConn
+	lastSeen int64
+}
+
+// startUDP binds the listen address of a udp backend. Callers must hold h.
+func (h *HollerProxy) startUDP(b *Backend) error {
+	if len(b.Listen) == 0 {
+		return errors.New(b.Kind + " backend " + b.NamedRoute + " requires a listen address")
+	}
+
+	if _, ok := h.udpListeners[b.Listen]; ok {
+		return errors.New("listen address " + b.Listen + " already in use")
+	}
+
+	if b.UDPSessionTimeout == 0 {
+		b.UDPSessionTimeout = defaultUDPSessionTimeout
+	}
+
+	conn, err := net.ListenPacket("udp", b.Listen)
+	if err != nil {
+		return err
+	}
+
+	l := &udpListener{
+		backend:  b,
+		conn:     conn,
+		timeout:  time.Duration(b.UDPSessionTimeout) * time.Second,
+		log:      h.Log.WithFields(logrus.Fields{"listen": b.Listen, "kind": b.Kind}),
+		metrics:  h.metrics,
+		sessions: make(map[string]*udpSession),
+	}
+	h.udpListeners[b.Listen] = l
+
+	go l.serve()
+	return nil
+}
+
+// stopUDP closes the listener of a udp backend and all of its sessions.
+// Callers must hold h.
+func (h *HollerProxy) stopUDP(b *Backend) error {
+	l, ok := h.udpListeners[b.Listen]
+	if !ok {
+		return errors.New("no listener on " + b.Listen + " for backend " + b.NamedRoute)
+	}
+	delete(h.udpListeners, b.Listen)
+
+	l.Lock()
+	for key, s := range l.sessions {
+		s.upstream.Close()
+		delete(l.sessions, key)
+	}
+	l.Unlock()
+
+	return l.conn.Close()
+}
+
+func (l *udpListener) serve() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, client, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.log.Warn(err)
+				continue
+			}
+			l.log.Debugf("listener stopped: %s", err)
+			return
+		}
+
+		s, err := l.session(client)
+		if err != nil {
+			l.log.Errorf("backend %s: %s", l.backend.NamedRoute, err)
+			continue
+		}
+
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			l.log.Debugf("writing to %s for %s: %s", s.target.URL, client, err)
+			continue
+		}
+		l.metrics.bytesIn.add(float64(n), l.backend.NamedRoute, s.target.URL)
+	}
+}
+
+// session returns the session for a client address, starting a new one when
+// there is none or when its target has since become unhealthy. The upstream
+// socket is dialed without holding l, so the session is only added if no
+// other one was started for the client in the meantime.
+func (l *udpListener) session(client net.Addr) (*udpSession, error) {
+	key := client.String()
+
+	l.Lock()
+	s, ok := l.sessions[key]
+	l.Unlock()
+	if ok && s.target.healthy() {
+		return s, nil
+	}
+
+	target, err := l.backend.selectTarget(nil, addrIP(client), nil)
+	if err != nil {
+		return nil, err
+	}
+	// a panicking backend can pick the same unhealthy target again
+	if ok && s.target == target {
+		return s, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", targetAddr(target))
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if current, found := l.sessions[key]; found {
+		if !ok || current != s {
+			upstream.Close()
+			return current, nil
+		}
+		l.log.Debugf("target %s for %s unhealthy, re-pinning session", s.target.URL, key)
+		delete(l.sessions, key)
+		s.upstream.Close()
+	}
+
+	s = &udpSession{
+		client:   client,
+		target:   target,
+		upstream: upstream,
+		lastSeen: time.Now().UnixNano(),
+	}
+	l.sessions[key] = s
+	atomic.AddInt64(&target.active, 1)
+	l.metrics.connections.add(1, l.backend.NamedRoute, target.URL)
+	l.log.Debugf("new session %s to %s for backend %s", key, target.URL, l.backend.NamedRoute)
+
+	go l.relay(s)
+	return s, nil
+}
+
+// relay copies replies from the upstream back to the client until the
+// session has been idle for the backend's session timeout.
+func (l *udpListener) relay(s *udpSession) {
+	buf := make([]byte, udpMaxDatagram)
+	defer l.expire(s)
+
+	for {
+		s.upstream.SetReadDeadline(time.Now().Add(l.timeout))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen)))
+				if idle < l.timeout {
+					continue
+				}
+				return
+			}
+			// Refused datagrams surface as read errors on connected sockets,
+			// the session stays up so the client can retry.
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return
+		}
+
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		if _, err := l.conn.WriteTo(buf[:n], s.client); err != nil {
+			l.log.Debugf("writing to %s: %s", s.client, err)
+			continue
+		}
+		l.metrics.bytesOut.add(float64(n), l.backend.NamedRoute, s.target.URL)
+	}
+}
+
+func (l *udpListener) expire(s *udpSession) {
+	l.Lock()
+	defer l.Unlock()
+
+	key := s.client.String()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	s.upstream.Close()
+	atomic.AddInt64(&s.target.active, -1)
+	l.log.Debugf("session %s to %s closed", key, s.target.URL)
+}
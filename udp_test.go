@@ -0,0 +1,152 @@
+package holler
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// freeUDPAddr returns a loopback address with a udp port nothing listens on.
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// udpUpstream answers each datagram with name and the address it came from,
+// closed when the test ends.
+func udpUpstream(t *testing.T, name string) *Target {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			_, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte(name+" "+from.String()), from)
+		}
+	}()
+	return &Target{URL: "udp://" + conn.LocalAddr().String(), Healthy: true}
+}
+
+// udpClient is a client socket of its own, so a session of its own.
+type udpClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newUDPClient(t *testing.T, addr string) *udpClient {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &udpClient{t: t, conn: conn}
+}
+
+// ask sends a datagram and returns the name of the target that answered and
+// the address of the session socket it was sent from.
+func (c *udpClient) ask() (string, string) {
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.conn.Write([]byte("ping")); err != nil {
+		c.t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	reply := strings.SplitN(string(buf[:n]), " ", 2)
+	return reply[0], reply[1]
+}
+
+func udpProxy(t *testing.T, targets ...*Target) (*HollerProxy, *Backend) {
+	h := newTestProxy(t)
+	b := &Backend{NamedRoute: "dns", Kind: KindUDP, Listen: freeUDPAddr(t), UDPSessionTimeout: 1, TargetSelector: SelectorRoundRobin, Targets: targets}
+	if err := h.RegisterBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.DeleteBackend(b) })
+	return h, b
+}
+
+func sessions(h *HollerProxy, b *Backend) int {
+	l := h.udpListeners[b.Listen]
+	l.Lock()
+	defer l.Unlock()
+	return len(l.sessions)
+}
+
+func TestUDPSessionAffinity(t *testing.T) {
+	a, other := udpUpstream(t, "a"), udpUpstream(t, "b")
+	h, b := udpProxy(t, a, other)
+
+	first, second := newUDPClient(t, b.Listen), newUDPClient(t, b.Listen)
+	target1, session1 := first.ask()
+	target2, _ := second.ask()
+	if target1 == target2 {
+		t.Errorf("round robin put both clients on %s", target1)
+	}
+	for i := 0; i < 5; i++ {
+		if target, session := first.ask(); target != target1 || session != session1 {
+			t.Fatalf("datagram %d went to %s from %s, want %s from %s", i, target, session, target1, session1)
+		}
+	}
+	if n := sessions(h, b); n != 2 {
+		t.Errorf("got %d sessions for two clients", n)
+	}
+
+	// once its target is unhealthy the client moves to the other one
+	pinned := a
+	if target1 == "b" {
+		pinned = other
+	}
+	pinned.setHealthy(false)
+	if target, _ := first.ask(); target == target1 {
+		t.Errorf("client still on unhealthy target %s", target)
+	}
+	if n := sessions(h, b); n != 2 {
+		t.Errorf("got %d sessions after re-pinning, want 2", n)
+	}
+}
+
+func TestUDPSessionIdleTimeout(t *testing.T) {
+	target := udpUpstream(t, "a")
+	h, b := udpProxy(t, target)
+
+	client := newUDPClient(t, b.Listen)
+	_, before := client.ask()
+	if n := sessions(h, b); n != 1 || atomic.LoadInt64(&target.active) != 1 {
+		t.Fatalf("got %d sessions and %d active, want 1", n, atomic.LoadInt64(&target.active))
+	}
+
+	// a session used within the timeout stays up
+	time.Sleep(600 * time.Millisecond)
+	if _, session := client.ask(); session != before {
+		t.Fatal("session closed before it was idle for the timeout")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for sessions(h, b) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session never closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&target.active); n != 0 {
+		t.Errorf("target has %d active sessions after expiry", n)
+	}
+	if _, after := client.ask(); after == before {
+		t.Error("client reused the expired session's socket")
+	}
+}